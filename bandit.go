@@ -0,0 +1,301 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ASSIGN_THOMPSON allocates responses to the cells of a design by Thompson
+// sampling on the reward of earlier completed responses. Every cell is an
+// arm, so designs using it usually have one factor whose levels pin prompt
+// versions.
+const ASSIGN_THOMPSON = "thompson"
+
+const (
+	PURPOSE_BANDIT = "bandit"
+	// DEFAULT_BANDIT_DRAWS is the number of posterior samples used to
+	// estimate the allocation probabilities.
+	DEFAULT_BANDIT_DRAWS = 1000
+)
+
+// Answers that mean an optional question was not answered. They are left
+// out of the reward counts rather than counted as failures.
+var unansweredOutcomes = []string{""}
+
+var (
+	rewardStmt           *sql.Stmt
+	allocationCountStmt  *sql.Stmt
+	allocationInsertStmt *sql.Stmt
+	allocationQueryStmt  *sql.Stmt
+)
+
+// Bandit configures ASSIGN_THOMPSON.
+type Bandit struct {
+	// Outcome is the ID of the post-survey question rewarded.
+	Outcome string `json:"outcome"`
+	// Rewards are the answers to Outcome that count as a success. Any other
+	// answer is a failure.
+	Rewards []string `json:"rewards"`
+	// BurnIn is the number of responses allocated uniformly before the
+	// rewards are used.
+	BurnIn int `json:"burn_in"`
+	// Floor is the minimum allocation probability of every arm.
+	Floor float64 `json:"floor"`
+	Draws int     `json:"draws,omitempty"`
+}
+
+func (b *Bandit) Validate(arms int, questionnaire Questionnaire) error {
+	if b == nil {
+		return errors.New("thompson assignment needs bandit settings")
+	}
+	if _, ok := questionnaire.Question(WAVE_POST, b.Outcome); !ok {
+		return fmt.Errorf("unknown bandit outcome %q", b.Outcome)
+	}
+	if len(b.Rewards) == 0 {
+		return errors.New("bandit needs at least one reward answer")
+	}
+	if b.BurnIn < 0 || b.Draws < 0 {
+		return errors.New("bandit burn_in and draws cannot be negative")
+	}
+	if b.Floor < 0 || b.Floor*float64(arms) > 1 {
+		return fmt.Errorf("bandit floor %g is not between 0 and 1/%d", b.Floor, arms)
+	}
+	return nil
+}
+
+func (b *Bandit) draws() int {
+	if b.Draws == 0 {
+		return DEFAULT_BANDIT_DRAWS
+	}
+	return b.Draws
+}
+
+// ArmAllocation is the state of one arm when a response was allocated.
+type ArmAllocation struct {
+	Cell        string  `json:"cell"`
+	Successes   int     `json:"successes"`
+	Failures    int     `json:"failures"`
+	Probability float64 `json:"probability"`
+}
+
+// Allocation records the probabilities a response was allocated with, so
+// the analysis can weight responses by their inverse.
+type Allocation struct {
+	BurnIn bool            `json:"burn_in"`
+	Arms   []ArmAllocation `json:"arms"`
+}
+
+// allocate computes the allocation probabilities for responseID from the
+// rewards of the survey's completed responses. The survey's block row is
+// locked first, so concurrent entries read the counts one after another and
+// each sees the allocations committed before it.
+func allocate(tx *sql.Tx, design Design, surveyID uuid.UUID, seed int64, responseID uuid.UUID) (*Allocation, error) {
+	allocation := &Allocation{Arms: make([]ArmAllocation, design.CellCount())}
+	arms := map[string]int{}
+	for i := range allocation.Arms {
+		allocation.Arms[i].Cell = design.CellName(design.Cell(i))
+		arms[allocation.Arms[i].Cell] = i
+	}
+
+	if _, err := lockBlock(tx, surveyID, ""); err != nil {
+		return nil, err
+	}
+	var allocated int
+	err := tx.Stmt(allocationCountStmt).QueryRow(surveyID).Scan(&allocated)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute allocationCountStmt: %v", err)
+	}
+	allocation.BurnIn = allocated < design.Bandit.BurnIn
+
+	rows, err := tx.Stmt(rewardStmt).Query(surveyID, design.Bandit.Outcome, pq.Array(design.Bandit.Rewards), pq.Array(unansweredOutcomes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute rewardStmt: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cell string
+		var successes, failures int
+		if err := rows.Scan(&cell, &successes, &failures); err != nil {
+			return nil, err
+		}
+		// Responses from cells no longer in the design are ignored.
+		if i, ok := arms[cell]; ok {
+			allocation.Arms[i].Successes = successes
+			allocation.Arms[i].Failures = failures
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	allocation.setProbabilities(design.Bandit, seededRand(seed, PURPOSE_BANDIT, responseID.String()))
+	return allocation, nil
+}
+
+// setProbabilities estimates the probability that each arm has the highest
+// success rate under a Beta(1, 1) prior, then raises every arm to the floor.
+// During the burn in every arm is equally likely.
+func (a *Allocation) setProbabilities(bandit *Bandit, r *rand.Rand) {
+	probabilities := make([]float64, len(a.Arms))
+	if a.BurnIn {
+		for i := range probabilities {
+			probabilities[i] = 1 / float64(len(a.Arms))
+		}
+	} else {
+		draws := bandit.draws()
+		for range draws {
+			best, bestSample := 0, -1.0
+			for i, arm := range a.Arms {
+				sample := betaSample(r, float64(arm.Successes+1), float64(arm.Failures+1))
+				if sample > bestSample {
+					best, bestSample = i, sample
+				}
+			}
+			probabilities[best]++
+		}
+		for i := range probabilities {
+			probabilities[i] /= float64(draws)
+		}
+	}
+	scale := 1 - bandit.Floor*float64(len(a.Arms))
+	for i := range a.Arms {
+		a.Arms[i].Probability = bandit.Floor + scale*probabilities[i]
+	}
+}
+
+// draw picks the index of an arm with the allocation probabilities.
+func (a *Allocation) draw(r *rand.Rand) int {
+	u := r.Float64()
+	for i, arm := range a.Arms {
+		u -= arm.Probability
+		if u < 0 {
+			return i
+		}
+	}
+	return len(a.Arms) - 1
+}
+
+// betaSample draws from Beta(alpha, beta) as the ratio of two gamma draws.
+func betaSample(r *rand.Rand, alpha float64, beta float64) float64 {
+	x := gammaSample(r, alpha)
+	y := gammaSample(r, beta)
+	return x / (x + y)
+}
+
+// gammaSample draws from Gamma(shape, 1) with the Marsaglia and Tsang method.
+// The bandit only uses shapes of at least one.
+func gammaSample(r *rand.Rand, shape float64) float64 {
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := r.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := r.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// logAllocation stores the allocation of a response inserted within tx.
+func logAllocation(tx *sql.Tx, surveyID uuid.UUID, responseID uuid.UUID, ra ResponseAssignment) error {
+	arms, err := json.Marshal(ra.Allocation.Arms)
+	if err != nil {
+		return fmt.Errorf("unable to marshal allocation: %v", err)
+	}
+	var probability float64
+	for _, arm := range ra.Allocation.Arms {
+		if arm.Cell == ra.Cell {
+			probability = arm.Probability
+		}
+	}
+	_, err = tx.Stmt(allocationInsertStmt).Exec(surveyID, responseID, ra.Cell, probability, ra.Allocation.BurnIn, string(arms))
+	if err != nil {
+		return fmt.Errorf("failed to execute allocationInsertStmt: %v", err)
+	}
+	return nil
+}
+
+// AllocationLogEntry is one row of the allocation log with the outcome of
+// the response once it completed.
+type AllocationLogEntry struct {
+	ResponseID  uuid.UUID       `json:"response_id"`
+	Cell        string          `json:"cell"`
+	Probability float64         `json:"probability"`
+	BurnIn      bool            `json:"burn_in"`
+	Arms        []ArmAllocation `json:"arms"`
+	Outcome     string          `json:"outcome"`
+	Completed   bool            `json:"completed"`
+	CreateTime  time.Time       `json:"create_time"`
+}
+
+func allocationLog(surveyID uuid.UUID) ([]AllocationLogEntry, error) {
+	var config SurveyConfig
+	err := config.Scan(surveyConfigQueryStmt.QueryRow(surveyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get survey config: %v", err)
+	}
+	if config.Design.Bandit == nil {
+		return nil, fmt.Errorf("survey %s does not use a bandit", surveyID)
+	}
+	rows, err := allocationQueryStmt.Query(surveyID, config.Design.Bandit.Outcome)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute allocationQueryStmt: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []AllocationLogEntry{}
+	for rows.Next() {
+		var entry AllocationLogEntry
+		var arms []byte
+		err := rows.Scan(&entry.ResponseID, &entry.Cell, &entry.Probability, &entry.BurnIn, &arms,
+			&entry.Outcome, &entry.Completed, &entry.CreateTime)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(arms, &entry.Arms); err != nil {
+			return nil, fmt.Errorf("unable to decode allocation of %s: %v", entry.ResponseID, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func handleAllocationLog(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != os.Getenv("LUCIDHQ_API_KEY") {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	surveyID, err := uuid.Parse(r.URL.Query().Get("survey-id"))
+	if err != nil {
+		log.Printf("unable to parse survey-id %s: %v\n", r.URL.Query().Get("survey-id"), err)
+		http.Error(w, "invalid survey-id parameter", http.StatusBadRequest)
+		return
+	}
+	entries, err := allocationLog(surveyID)
+	if err != nil {
+		log.Printf("failed to read allocation log: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(entries)
+	if err != nil {
+		log.Printf("unable to encode allocation log: %v\n", err)
+	}
+}
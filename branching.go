@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Condition decides whether a page or question is shown to a response. A
+// question is shown when its own condition and the one of its page hold,
+// and a page is shown when it has a question to show. Conditions are
+// evaluated on the server from answers on earlier pages, so the pages a
+// respondent sees follow from the answers they gave and going back retraces
+// the path they took.
+type Condition struct {
+	// Question is the ID of an earlier question whose answer must be one of
+	// Values. Wave is the wave it is asked in, the wave of the condition
+	// unless set. Post wave conditions can refer to any pre wave question.
+	Wave     string   `json:"wave,omitempty"`
+	Question string   `json:"question,omitempty"`
+	Values   []string `json:"values,omitempty"`
+	// Conditions are the experiment conditions, such as "debate", the
+	// response must be assigned to.
+	Conditions []string `json:"conditions,omitempty"`
+}
+
+// answerWave returns the wave of the question c refers to.
+func (c *Condition) answerWave(wave string) string {
+	if c.Wave == "" {
+		return wave
+	}
+	return c.Wave
+}
+
+// validate checks c can be evaluated in wave, where earlier holds the IDs of
+// the questions on earlier pages.
+func (c *Condition) validate(q Questionnaire, wave string, earlier map[string]bool) error {
+	if c == nil {
+		return nil
+	}
+	if c.Question == "" && len(c.Conditions) == 0 {
+		return errors.New("show_if needs a question or conditions")
+	}
+	if c.Question != "" {
+		switch answerWave := c.answerWave(wave); {
+		case answerWave == wave:
+			if !earlier[c.Question] {
+				return fmt.Errorf("show_if refers to %q, which is not on an earlier page", c.Question)
+			}
+		case answerWave == WAVE_PRE && wave == WAVE_POST:
+			if _, ok := q.Question(WAVE_PRE, c.Question); !ok {
+				return fmt.Errorf("show_if refers to unknown pre question %q", c.Question)
+			}
+		default:
+			return fmt.Errorf("show_if cannot refer to the %s wave", answerWave)
+		}
+		if len(c.Values) == 0 {
+			return fmt.Errorf("show_if on %q needs values", c.Question)
+		}
+	}
+	for _, condition := range c.Conditions {
+		if !validCondition(condition) {
+			return fmt.Errorf("show_if has unknown condition %q", condition)
+		}
+	}
+	return nil
+}
+
+// holds evaluates c for sq in wave. A nil condition always holds.
+func (c *Condition) holds(sq SurveyResponse, wave string) bool {
+	if c == nil {
+		return true
+	}
+	if c.Question != "" {
+		answer := sq.Waves[c.answerWave(wave)][c.Question]
+		if !slices.Contains(c.Values, answer) {
+			return false
+		}
+	}
+	if len(c.Conditions) > 0 && !slices.Contains(c.Conditions, sq.Condition) {
+		return false
+	}
+	return true
+}
+
+// refers reports whether c depends on the answer to one of questions, which
+// are asked in wave.
+func (c *Condition) refers(wave string, questions []Question) bool {
+	if c == nil || c.Question == "" || c.answerWave(wave) != wave {
+		return false
+	}
+	return slices.ContainsFunc(questions, func(q Question) bool { return q.ID == c.Question })
+}
+
+// validateBranching checks the conditions of the pages of wave. The first
+// page must always be shown, so every response has somewhere to start.
+func (q Questionnaire) validateBranching(wave string) error {
+	pages := q.Pages(wave)
+	first := pages[0]
+	if first.ShowIf != nil || !slices.ContainsFunc(first.Questions, func(q Question) bool { return q.ShowIf == nil }) {
+		return fmt.Errorf("the first %s page needs a question shown to every response", wave)
+	}
+	earlier := map[string]bool{}
+	for i, page := range pages {
+		if err := page.ShowIf.validate(q, wave, earlier); err != nil {
+			return fmt.Errorf("%s page %d: %v", wave, i+1, err)
+		}
+		for _, question := range page.Questions {
+			if err := question.ShowIf.validate(q, wave, earlier); err != nil {
+				return fmt.Errorf("%s question %s: %v", wave, question.ID, err)
+			}
+		}
+		for _, question := range page.Questions {
+			earlier[question.ID] = true
+		}
+	}
+	return nil
+}
+
+// shownQuestions returns the questions of page shown to sq.
+func (sq SurveyResponse) shownQuestions(wave string, page Page) []Question {
+	if !page.ShowIf.holds(sq, wave) {
+		return nil
+	}
+	var shown []Question
+	for _, question := range page.Questions {
+		if question.ShowIf.holds(sq, wave) {
+			shown = append(shown, question)
+		}
+	}
+	return shown
+}
+
+// path returns the indexes of the pages of wave shown to sq, in order.
+func (sq SurveyResponse) path(wave string, pages []Page) []int {
+	var path []int
+	for i, page := range pages {
+		if len(sq.shownQuestions(wave, page)) > 0 {
+			path = append(path, i)
+		}
+	}
+	return path
+}
+
+// hiddenAnswers removes the answers of sq to questions of wave that are no
+// longer shown, which happens when an earlier answer is changed, and returns
+// their IDs. Pages are visited in order so answers removed from a page are
+// not used to show later ones.
+func (sq *SurveyResponse) hiddenAnswers(wave string, pages []Page) []string {
+	var hidden []string
+	for _, page := range pages {
+		shown := sq.shownQuestions(wave, page)
+		for _, question := range page.Questions {
+			if _, ok := sq.Answers[question.ID]; ok && !slices.ContainsFunc(shown, func(q Question) bool { return q.ID == question.ID }) {
+				hidden = append(hidden, question.ID)
+				delete(sq.Answers, question.ID)
+			}
+		}
+	}
+	return hidden
+}
+
+// lastPage reports whether page, at index of pages, is the last page of wave
+// shown to sq. Later pages that depend on an answer to page are counted as
+// shown since the answer may still change.
+func (sq SurveyResponse) lastPage(wave string, pages []Page, index int) bool {
+	questions := pages[index].Questions
+	for _, page := range pages[index+1:] {
+		if len(sq.shownQuestions(wave, page)) > 0 || page.ShowIf.refers(wave, questions) {
+			return false
+		}
+		for _, question := range page.Questions {
+			if question.ShowIf.refers(wave, questions) {
+				return false
+			}
+		}
+	}
+	return true
+}
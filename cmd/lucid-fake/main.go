@@ -0,0 +1,32 @@
+// Command lucid-fake serves the in-memory Lucid API of package lucidtest, so
+// the deploy flow can run without touching samplicio.us. Start it and point
+// the app at it:
+//
+//	go run ./cmd/lucid-fake -addr :8081
+//	LUCID_BASE_URL=http://localhost:8081 go run .
+//
+// Every call it receives is logged.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/joho/godotenv"
+	"github.com/loganamcnichols/ai-debate/lucid/lucidtest"
+)
+
+func main() {
+	addr := flag.String("addr", ":8081", "address to listen on")
+	flag.Parse()
+
+	// The key defaults to the one the app sends.
+	godotenv.Load()
+	h := lucidtest.NewHandler(os.Getenv("LUCIDHQ_API_KEY"))
+	h.Logger = log.Default()
+
+	log.Printf("serving fake Lucid API on %s\n", *addr)
+	log.Fatal(http.ListenAndServe(*addr, h))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// Experimental conditions a response can be assigned to. Every condition
+// uses the same timed chat page and the same survey afterwards; only what
+// happens in the chat differs.
+const (
+	// CONDITION_DEBATE is the full debate between the survey's personas.
+	CONDITION_DEBATE = "debate"
+	// CONDITION_SINGLE keeps one persona, the one that would have spoken
+	// first, so the participant only hears one side.
+	CONDITION_SINGLE = "single"
+	// CONDITION_NEUTRAL replaces the personas with NEUTRAL_PERSONA.
+	CONDITION_NEUTRAL = "neutral"
+	// CONDITION_STATIC shows each topic's reading without any LLM.
+	CONDITION_STATIC = "static"
+)
+
+var CONDITIONS = []string{CONDITION_DEBATE, CONDITION_SINGLE, CONDITION_NEUTRAL, CONDITION_STATIC}
+
+var DEFAULT_CONDITIONS = []string{CONDITION_DEBATE}
+
+// READING_ROLE is the chat message role of static readings.
+const READING_ROLE = "reading"
+
+// NEUTRAL_PERSONA answers questions with balanced information instead of
+// arguing a side.
+var NEUTRAL_PERSONA = Persona{Name: "InfoBot", Label: "Info Bot", Prompt: NEUTRAL_PROMPT}
+
+func validCondition(condition string) bool {
+	for _, c := range CONDITIONS {
+		if c == condition {
+			return true
+		}
+	}
+	return false
+}
+
+func validateConditions(conditions []string, topics []Topic) error {
+	if len(conditions) == 0 {
+		return errors.New("at least one condition is required")
+	}
+	for _, condition := range conditions {
+		if !validCondition(condition) {
+			return fmt.Errorf("unknown condition %q", condition)
+		}
+		if condition != CONDITION_STATIC {
+			continue
+		}
+		for i, topic := range topics {
+			if topic.Reading == "" {
+				return fmt.Errorf("condition %q needs a reading for topic %d", condition, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// parseConditions decodes the conditions JSON array sent to /deploy. An
+// empty parameter runs every response as a debate.
+func parseConditions(param string, topics []Topic) ([]string, error) {
+	if param == "" {
+		return DEFAULT_CONDITIONS, nil
+	}
+	var conditions []string
+	if err := json.Unmarshal([]byte(param), &conditions); err != nil {
+		return nil, fmt.Errorf("invalid conditions: %v", err)
+	}
+	return conditions, validateConditions(conditions, topics)
+}
+
+// ConditionPersonas returns the personas that take part in the chat for
+// condition. It is empty for CONDITION_STATIC.
+func (sc SurveyConfig) ConditionPersonas(condition string, innovateFirst bool) []Persona {
+	switch condition {
+	case CONDITION_SINGLE:
+		return []Persona{sc.Personas[rotationOffset(innovateFirst)%len(sc.Personas)]}
+	case CONDITION_NEUTRAL:
+		return []Persona{NEUTRAL_PERSONA}
+	case CONDITION_STATIC:
+		return nil
+	}
+	return sc.Personas
+}
+
+// streamReading shows the reading for topic in place of a bot reply.
+func streamReading(w http.ResponseWriter, questionID uuid.UUID, topic Topic) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("streaming unsupported")
+	}
+	msg := ChatMessage{
+		QuestionID: questionID,
+		Role:       READING_ROLE,
+	}
+	err := postTemplate(w, "chat-msg", "chat-msg", msg)
+	if err != nil {
+		return fmt.Errorf("failed to post chat-message template: %v", err)
+	}
+	fmt.Fprintf(w, "event: %s-%s\ndata: %s\n\n", questionID.String(), READING_ROLE, convertToParagraphs(topic.Reading))
+	flusher.Flush()
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// Exit statuses of a response. Each is redirected to its own Lucid exit
+// link.
+const (
+	EXIT_COMPLETE = "complete"
+	// EXIT_TERMINATE screens out a participant who does not qualify.
+	EXIT_TERMINATE = "terminate"
+	// EXIT_OVER_QUOTA turns away a participant whose quota cell is full.
+	EXIT_OVER_QUOTA = "over_quota"
+	// EXIT_QUALITY ends the response of a participant who failed an
+	// attention check or went inactive.
+	EXIT_QUALITY = "quality"
+)
+
+// ExitLink is the redirect of an exit status. The URL is read from Env and
+// falls back to Default.
+type ExitLink struct {
+	Status  string
+	Env     string
+	Default string
+}
+
+// EXIT_LINKS default to the Lucid client callback, except for completes,
+// which are confirmed with a token.
+var EXIT_LINKS = []ExitLink{
+	{Status: EXIT_COMPLETE, Env: "COMPLETE_URL", Default: "https://notch.insights.supply/cb?token=0433a930-10c5-46e0-b3e9-b99dfce1cdb4"},
+	{Status: EXIT_TERMINATE, Env: "TERMINATE_URL", Default: "https://www.samplicio.us/router/ClientCallBack.aspx?RIS=20"},
+	{Status: EXIT_OVER_QUOTA, Env: "OVER_QUOTA_URL", Default: "https://www.samplicio.us/router/ClientCallBack.aspx?RIS=30"},
+	{Status: EXIT_QUALITY, Env: "QUALITY_URL", Default: "https://www.samplicio.us/router/ClientCallBack.aspx?RIS=40"},
+}
+
+// exitURLs maps exit statuses to their parsed redirects.
+var exitURLs = map[string]*url.URL{}
+
+var exitStmt *sql.Stmt
+
+// initExitURLs parses the exit links.
+func initExitURLs() {
+	for _, link := range EXIT_LINKS {
+		rawURL := os.Getenv(link.Env)
+		if rawURL == "" {
+			rawURL = link.Default
+		}
+		exitURL, err := url.Parse(rawURL)
+		if err != nil {
+			log.Fatalf("invalid %s %s: %v\n", link.Env, rawURL, err)
+		}
+		exitURLs[link.Status] = exitURL
+	}
+}
+
+// validateExits checks the attention check and screen-out options of q.
+func (q Question) validateExits() error {
+	screenOut := slices.ContainsFunc(q.Options, func(o Option) bool { return o.ScreenOut })
+	if (len(q.Expect) > 0 || screenOut) && q.Type != QUESTION_SINGLE_CHOICE {
+		return fmt.Errorf("%s questions cannot be attention checks or screen out", q.Type)
+	}
+	if slices.ContainsFunc(q.Items, func(o Option) bool { return o.ScreenOut }) {
+		return errors.New("likert items cannot screen out")
+	}
+	for _, value := range q.Expect {
+		i := slices.IndexFunc(q.Options, func(o Option) bool { return o.Value == value })
+		if i < 0 {
+			return fmt.Errorf("expected answer %q is not an option", value)
+		}
+		if q.Options[i].ScreenOut {
+			return fmt.Errorf("expected answer %q screens out", value)
+		}
+	}
+	return nil
+}
+
+// exitStatus returns the exit the answers to page lead to, or "" if the
+// response continues. A failed attention check takes precedence over a
+// screen-out.
+func (p Page) exitStatus(answers map[string]string) string {
+	status := ""
+	for _, question := range p.Questions {
+		value, ok := answers[question.ID]
+		if !ok {
+			continue
+		}
+		if len(question.Expect) > 0 && !slices.Contains(question.Expect, value) {
+			return EXIT_QUALITY
+		}
+		if slices.ContainsFunc(question.Options, func(o Option) bool { return o.Value == value && o.ScreenOut }) {
+			status = EXIT_TERMINATE
+		}
+	}
+	return status
+}
+
+// recordExit stores status as the exit of the response with responseID and
+// returns the exit stored. A response keeps the first exit recorded, so a
+// participant who was terminated cannot complete later.
+func recordExit(responseID uuid.UUID, status string) (string, error) {
+	var stored string
+	err := exitStmt.QueryRow(responseID, status).Scan(&stored)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute exitStmt: %v", err)
+	}
+	return stored, nil
+}
+
+// exitSurvey ends survey with status and sends the participant to the exit
+// link of the exit stored. Responses without a survey were not sent by
+// Lucid and are shown a closing page instead.
+func exitSurvey(w http.ResponseWriter, r *http.Request, survey SurveyResponse, status string) {
+	status, err := recordExit(*survey.ID, status)
+	if err != nil {
+		log.Printf("unable to record exit: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if status == EXIT_COMPLETE {
+		_, err := completeStmt.Exec(survey.ID)
+		if err != nil {
+			log.Printf("failed to execute completeStmt: %v\n", err)
+		}
+	}
+	if survey.SurveyID == nil {
+		err := tmpls.ExecuteTemplate(w, "non-lucid-exit.html", status)
+		if err != nil {
+			log.Printf("unable to execute non-lucid exit: %v\n", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	exitURL := *exitURLs[status]
+	params := exitURL.Query()
+	params.Add("RID", survey.ResponseID)
+	exitURL.RawQuery = params.Encode()
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", exitURL.String())
+		return
+	}
+	http.Redirect(w, r, exitURL.String(), http.StatusFound)
+}
+
+// handleExit sends the response in the response-id parameter to the exit
+// recorded for it. The chat loads it once a participant has been ended for
+// inactivity.
+func handleExit(w http.ResponseWriter, r *http.Request) {
+	ID, err := uuid.Parse(r.URL.Query().Get("response-id"))
+	if err != nil {
+		log.Printf("unable to parse reponse id %s: %v\n", r.URL.Query().Get("response-id"), err)
+		http.Error(w, "invalid response-id", http.StatusBadRequest)
+		return
+	}
+	var survey SurveyResponse
+	err = survey.Scan(responseQueryStmt.QueryRow(ID))
+	if err != nil {
+		log.Printf("error scanning survey response: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if survey.ExitStatus == "" {
+		http.Error(w, "the response has not exited", http.StatusBadRequest)
+		return
+	}
+	exitSurvey(w, r, survey, survey.ExitStatus)
+}
+
+// quotaAnswer is the answer of p to a Lucid standard question.
+func (p Participant) quotaAnswer(question string) string {
+	switch question {
+	case "AGE":
+		return fmt.Sprint(p.Age)
+	case "GENDER":
+		return p.Gender
+	case "HISPANIC":
+		return p.Hispanic
+	case "ETHNICITY":
+		return p.Ethnicity
+	case "STANDARD_VOTE":
+		return p.StandardVote
+	case "ZIP":
+		return p.Zip
+	}
+	return ""
+}
+
+// overQuota reports whether p falls in a full quota cell of surveyID. Lucid
+// stops sending participants to full cells, but its counts lag behind.
+func overQuota(surveyID uuid.UUID, p Participant) (bool, error) {
+	fills, err := quotaFill(surveyID)
+	if err != nil {
+		return false, err
+	}
+	for _, fill := range fills {
+		if fill.Remaining == 0 && slices.Contains(fill.PreCodes, p.quotaAnswer(fill.Question)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
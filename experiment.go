@@ -0,0 +1,419 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Randomization methods for assigning responses to cells of a design.
+const (
+	// ASSIGN_SIMPLE draws every response's cell independently.
+	ASSIGN_SIMPLE = "simple"
+	// ASSIGN_BLOCKED deals cells from shuffled blocks that contain every
+	// cell equally often, so the arms stay balanced within each block.
+	ASSIGN_BLOCKED = "blocked"
+	// ASSIGN_STRATIFIED keeps separate blocks for every stratum.
+	ASSIGN_STRATIFIED = "stratified"
+)
+
+var ASSIGNMENT_METHODS = []string{ASSIGN_SIMPLE, ASSIGN_BLOCKED, ASSIGN_STRATIFIED, ASSIGN_THOMPSON}
+
+// STRATA are the participant attributes a design can stratify on. They come
+// from the Lucid entry link.
+var STRATA = map[string]func(Participant) string{
+	"age_band":      ageBand,
+	"gender":        func(p Participant) string { return p.Gender },
+	"hispanic":      func(p Participant) string { return p.Hispanic },
+	"ethnicity":     func(p Participant) string { return p.Ethnicity },
+	"standard_vote": func(p Participant) string { return p.StandardVote },
+}
+
+var factorNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// Effects are what a level changes about the chat. Fields left unset keep
+// the survey configuration.
+type Effects struct {
+	Condition     string `json:"condition,omitempty"`
+	InnovateFirst *bool  `json:"innovate_first,omitempty"`
+	// Generation is merged over the survey generation settings.
+	Generation GenerationSettings `json:"generation,omitempty"`
+	// BotSettings are merged over the survey's per bot settings.
+	BotSettings map[string]GenerationSettings `json:"bot_settings,omitempty"`
+	// PromptVersions pin prompt names to versions.
+	PromptVersions map[string]string `json:"prompt_versions,omitempty"`
+	// Labels replace the display label of personas, keyed by persona name.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// merge returns e with the effects set in other applied over it.
+func (e Effects) merge(other Effects) Effects {
+	if other.Condition != "" {
+		e.Condition = other.Condition
+	}
+	if other.InnovateFirst != nil {
+		e.InnovateFirst = other.InnovateFirst
+	}
+	e.Generation = e.Generation.Merge(other.Generation)
+	e.BotSettings = mergeMaps(e.BotSettings, other.BotSettings)
+	e.PromptVersions = mergeMaps(e.PromptVersions, other.PromptVersions)
+	e.Labels = mergeMaps(e.Labels, other.Labels)
+	return e
+}
+
+func mergeMaps[V any](base, override map[string]V) map[string]V {
+	if len(override) == 0 {
+		return base
+	}
+	merged := maps.Clone(base)
+	if merged == nil {
+		merged = map[string]V{}
+	}
+	maps.Copy(merged, override)
+	return merged
+}
+
+type Level struct {
+	Name string `json:"name"`
+	Effects
+}
+
+type Factor struct {
+	Name   string  `json:"name"`
+	Levels []Level `json:"levels"`
+}
+
+// Design is the experiment a survey runs. Every response is assigned one
+// level of every factor; a combination of levels is a cell.
+type Design struct {
+	Factors []Factor `json:"factors"`
+	Method  string   `json:"method"`
+	// BlockSize is the number of assignments per block for the blocked and
+	// stratified methods. It must be a multiple of the number of cells and
+	// defaults to the number of cells.
+	BlockSize int `json:"block_size,omitempty"`
+	// Strata name the participant attributes used by the stratified method.
+	Strata []string `json:"strata,omitempty"`
+	// Bandit configures the thompson method.
+	Bandit *Bandit `json:"bandit,omitempty"`
+}
+
+// Assignment maps each factor name to the name of the assigned level.
+type Assignment map[string]string
+
+// defaultDesign crosses the condition with who speaks first, in blocks of
+// one response per cell.
+func defaultDesign(conditions []string) Design {
+	innovateFirst, safetyFirst := true, false
+	design := Design{
+		Method: ASSIGN_BLOCKED,
+		Factors: []Factor{{
+			Name: "order",
+			Levels: []Level{
+				{Name: "innovate-first", Effects: Effects{InnovateFirst: &innovateFirst}},
+				{Name: "safety-first", Effects: Effects{InnovateFirst: &safetyFirst}},
+			},
+		}},
+	}
+	if len(conditions) > 1 {
+		factor := Factor{Name: "condition"}
+		for _, condition := range conditions {
+			factor.Levels = append(factor.Levels, Level{Name: condition, Effects: Effects{Condition: condition}})
+		}
+		design.Factors = append([]Factor{factor}, design.Factors...)
+	} else {
+		for i := range design.Factors[0].Levels {
+			design.Factors[0].Levels[i].Condition = conditions[0]
+		}
+	}
+	return design
+}
+
+// CellCount is the number of combinations of levels.
+func (d Design) CellCount() int {
+	count := 1
+	for _, factor := range d.Factors {
+		count *= len(factor.Levels)
+	}
+	return count
+}
+
+// blockSize returns the configured block size or one of every cell.
+func (d Design) blockSize() int {
+	if d.BlockSize == 0 {
+		return d.CellCount()
+	}
+	return d.BlockSize
+}
+
+// Cell returns the assignment for the cell at index. The last factor varies
+// fastest.
+func (d Design) Cell(index int) Assignment {
+	assignment := Assignment{}
+	for i := len(d.Factors) - 1; i >= 0; i-- {
+		factor := d.Factors[i]
+		assignment[factor.Name] = factor.Levels[index%len(factor.Levels)].Name
+		index /= len(factor.Levels)
+	}
+	return assignment
+}
+
+// CellName identifies the cell of assignment in exports, e.g.
+// "condition=debate,order=innovate-first".
+func (d Design) CellName(assignment Assignment) string {
+	parts := make([]string, len(d.Factors))
+	for i, factor := range d.Factors {
+		parts[i] = factor.Name + "=" + assignment[factor.Name]
+	}
+	return strings.Join(parts, ",")
+}
+
+// Stratum identifies the stratum participant falls in for the stratified
+// method. It is empty for the other methods.
+func (d Design) Stratum(participant Participant) string {
+	if d.Method != ASSIGN_STRATIFIED {
+		return ""
+	}
+	parts := make([]string, len(d.Strata))
+	for i, name := range d.Strata {
+		parts[i] = name + "=" + STRATA[name](participant)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Resolve combines the effects of every level in assignment, in factor order.
+func (d Design) Resolve(assignment Assignment) Effects {
+	var effects Effects
+	for _, factor := range d.Factors {
+		for _, level := range factor.Levels {
+			if level.Name == assignment[factor.Name] {
+				effects = effects.merge(level.Effects)
+			}
+		}
+	}
+	return effects
+}
+
+func (d Design) Validate(personas []Persona, topics []Topic, questionnaire Questionnaire) error {
+	if len(d.Factors) == 0 {
+		return errors.New("a design needs at least one factor")
+	}
+	if !slices.Contains(ASSIGNMENT_METHODS, d.Method) {
+		return fmt.Errorf("unknown assignment method %q", d.Method)
+	}
+	if d.Method == ASSIGN_STRATIFIED && len(d.Strata) == 0 {
+		return errors.New("stratified assignment needs at least one stratum")
+	}
+	for _, name := range d.Strata {
+		if _, ok := STRATA[name]; !ok {
+			return fmt.Errorf("unknown stratum %q", name)
+		}
+	}
+
+	personaNames := map[string]bool{}
+	for _, persona := range personas {
+		personaNames[persona.Name] = true
+	}
+	factorNames := map[string]bool{}
+	for _, factor := range d.Factors {
+		if !factorNamePattern.MatchString(factor.Name) || factorNames[factor.Name] {
+			return fmt.Errorf("invalid or duplicate factor name %q", factor.Name)
+		}
+		factorNames[factor.Name] = true
+		if len(factor.Levels) == 0 {
+			return fmt.Errorf("factor %s has no levels", factor.Name)
+		}
+		levelNames := map[string]bool{}
+		for _, level := range factor.Levels {
+			if !factorNamePattern.MatchString(level.Name) || levelNames[level.Name] {
+				return fmt.Errorf("factor %s has an invalid or duplicate level name %q", factor.Name, level.Name)
+			}
+			levelNames[level.Name] = true
+			if err := level.validate(personaNames, topics); err != nil {
+				return fmt.Errorf("factor %s level %s: %v", factor.Name, level.Name, err)
+			}
+		}
+	}
+	if d.BlockSize < 0 || d.blockSize()%d.CellCount() != 0 {
+		return fmt.Errorf("block size %d is not a multiple of the %d cells", d.BlockSize, d.CellCount())
+	}
+	if d.Method == ASSIGN_THOMPSON {
+		return d.Bandit.Validate(d.CellCount(), questionnaire)
+	}
+	return nil
+}
+
+func (l Level) validate(personaNames map[string]bool, topics []Topic) error {
+	if l.Condition != "" {
+		if err := validateConditions([]string{l.Condition}, topics); err != nil {
+			return err
+		}
+	}
+	if err := l.Generation.Validate(); err != nil {
+		return err
+	}
+	for name, gs := range l.BotSettings {
+		if err := gs.Validate(); err != nil {
+			return fmt.Errorf("bot settings for %s: %v", name, err)
+		}
+	}
+	for name, version := range l.PromptVersions {
+		if _, err := promptRegistry.Get(name, version); err != nil {
+			return err
+		}
+	}
+	for name := range l.Labels {
+		if !personaNames[name] {
+			return fmt.Errorf("label for unknown persona %s", name)
+		}
+	}
+	return nil
+}
+
+// parseDesign decodes the design JSON object sent to /deploy. An empty
+// parameter uses defaultDesign.
+func parseDesign(param string, conditions []string, personas []Persona, topics []Topic, questionnaire Questionnaire) (Design, error) {
+	if param == "" {
+		return defaultDesign(conditions), nil
+	}
+	var design Design
+	if err := json.Unmarshal([]byte(param), &design); err != nil {
+		return design, fmt.Errorf("invalid design: %v", err)
+	}
+	if design.Method == "" {
+		design.Method = ASSIGN_SIMPLE
+	}
+	return design, design.Validate(personas, topics, questionnaire)
+}
+
+func ageBand(p Participant) string {
+	switch {
+	case p.Age == 0:
+		return "unknown"
+	case p.Age < 30:
+		return "18-29"
+	case p.Age < 45:
+		return "30-44"
+	case p.Age < 65:
+		return "45-64"
+	}
+	return "65+"
+}
+
+// ResponseAssignment is everything randomized for a response when it enters.
+type ResponseAssignment struct {
+	Assignment    Assignment
+	Cell          string
+	Stratum       string
+	Condition     string
+	InnovateFirst bool
+	// Slot is where in the survey's blocks the cell was dealt from. It is
+	// nil for simple randomization.
+	Slot *BlockSlot
+	// Allocation is the bandit state the cell was drawn with. It is nil
+	// unless the design uses the thompson method.
+	Allocation *Allocation
+}
+
+// assign randomizes the new response responseID of surveyID into a cell of
+// design. The blocked methods take the next slot of the survey's blocks
+// within tx, which should also insert the response so a rolled back entry
+// does not use up a slot.
+func assign(tx *sql.Tx, design Design, surveyID uuid.UUID, seed int64, responseID uuid.UUID, participant Participant) (ResponseAssignment, error) {
+	stratum := design.Stratum(participant)
+	var slot *BlockSlot
+	var allocation *Allocation
+	switch design.Method {
+	case ASSIGN_SIMPLE:
+	case ASSIGN_THOMPSON:
+		var err error
+		allocation, err = allocate(tx, design, surveyID, seed, responseID)
+		if err != nil {
+			return ResponseAssignment{}, err
+		}
+	default:
+		next, err := nextBlockSlot(tx, surveyID, stratum, design.blockSize())
+		if err != nil {
+			return ResponseAssignment{}, err
+		}
+		slot = &next
+	}
+	return design.assignment(seed, responseID, stratum, slot, allocation), nil
+}
+
+// assignment computes a response's assignment from seed. It only depends on
+// stored values so the assignment audit can recompute it.
+func (d Design) assignment(seed int64, responseID uuid.UUID, stratum string, slot *BlockSlot, allocation *Allocation) ResponseAssignment {
+	var cell int
+	switch {
+	case allocation != nil:
+		cell = allocation.draw(responseRand(seed, responseID, PURPOSE_CELL))
+	case slot != nil:
+		cell = permutedBlock(seed, stratum, slot.Number, d.CellCount(), d.blockSize())[slot.Index]
+	default:
+		cell = responseRand(seed, responseID, PURPOSE_CELL).Intn(d.CellCount())
+	}
+
+	assignment := d.Cell(cell)
+	effects := d.Resolve(assignment)
+	ra := ResponseAssignment{
+		Assignment: assignment,
+		Cell:       d.CellName(assignment),
+		Stratum:    stratum,
+		Condition:  CONDITION_DEBATE,
+		Slot:       slot,
+		Allocation: allocation,
+	}
+	if effects.Condition != "" {
+		ra.Condition = effects.Condition
+	}
+	// Speaking order is still randomized when no factor controls it.
+	if effects.InnovateFirst != nil {
+		ra.InnovateFirst = *effects.InnovateFirst
+	} else {
+		ra.InnovateFirst = responseRand(seed, responseID, PURPOSE_ORDER).Float32() > 0.5
+	}
+	return ra
+}
+
+// WithAssignment returns the survey configuration as seen by a response
+// assigned to assignment.
+func (sc SurveyConfig) WithAssignment(assignment Assignment) SurveyConfig {
+	effects := sc.Design.Resolve(assignment)
+	sc.Generation = sc.Generation.Merge(effects.Generation)
+	for name, gs := range effects.BotSettings {
+		sc.BotOverrides = mergeMaps(sc.BotOverrides, map[string]GenerationSettings{
+			name: sc.BotOverrides[name].Merge(gs),
+		})
+	}
+	sc.PromptVersions = mergeMaps(sc.PromptVersions, effects.PromptVersions)
+	if len(effects.Labels) > 0 {
+		personas := slices.Clone(sc.Personas)
+		for i, persona := range personas {
+			if label, ok := effects.Labels[persona.Name]; ok {
+				personas[i].Label = label
+			}
+		}
+		sc.Personas = personas
+	}
+	return sc
+}
+
+// scanAssignment decodes a response's assignment column.
+func scanAssignment(data []byte) (Assignment, error) {
+	assignment := Assignment{}
+	if len(data) == 0 {
+		return assignment, nil
+	}
+	if err := json.Unmarshal(data, &assignment); err != nil {
+		return nil, fmt.Errorf("unable to decode assignment: %v", err)
+	}
+	return assignment, nil
+}
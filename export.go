@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	exportResponseStmt *sql.Stmt
+	exportAnswerStmt   *sql.Stmt
+)
+
+// EXPORT_COLUMNS are the response columns that start every export row.
+var EXPORT_COLUMNS = []string{
+	"id",
+	"response_id",
+	"cell",
+	"condition",
+	"innovate_first",
+	"start_time",
+	"pre_complete_time",
+	"complete_time",
+	"exit_status",
+}
+
+// exportColumns names the export columns of q in wave. Likert questions
+// get a column per item and ranking questions a column per option.
+func (q Question) exportColumns(wave string) []string {
+	prefix := wave + "." + q.ID
+	switch q.Type {
+	case QUESTION_LIKERT:
+		columns := make([]string, len(q.Items))
+		for i, item := range q.Items {
+			columns[i] = prefix + "." + item.Value
+		}
+		return columns
+	case QUESTION_RANKING:
+		columns := make([]string, len(q.Options))
+		for i, option := range q.Options {
+			columns[i] = prefix + "." + option.Value
+		}
+		return columns
+	}
+	return []string{prefix}
+}
+
+// exportValues converts a stored answer to the values of its export
+// columns. Likert columns hold the chosen option and ranking columns the
+// rank of the option, starting at 1.
+func (q Question) exportValues(value string) []string {
+	switch q.Type {
+	case QUESTION_LIKERT:
+		grid := decodeGrid(value)
+		values := make([]string, len(q.Items))
+		for i, item := range q.Items {
+			values[i] = grid[item.Value]
+		}
+		return values
+	case QUESTION_RANKING:
+		ranks := map[string]int{}
+		for i, option := range decodeRanking(value) {
+			ranks[option] = i + 1
+		}
+		values := make([]string, len(q.Options))
+		for i, option := range q.Options {
+			if rank, ok := ranks[option.Value]; ok {
+				values[i] = strconv.Itoa(rank)
+			}
+		}
+		return values
+	}
+	return []string{value}
+}
+
+// exportAnswer is a stored answer and the order it was presented in.
+type exportAnswer struct {
+	value    string
+	position sql.NullInt64
+	order    []string
+}
+
+// orderColumns names the columns recording the presentation order of q in
+// wave: its position when its page is randomized and the position of each
+// option when its options are.
+func (q Question) orderColumns(wave string, page Page) []string {
+	prefix := wave + "." + q.ID + ".position"
+	var columns []string
+	if page.Randomize {
+		columns = append(columns, prefix)
+	}
+	if q.Randomize {
+		for _, value := range q.presentedOrder() {
+			columns = append(columns, prefix+"."+value)
+		}
+	}
+	return columns
+}
+
+// orderValues returns the values of the orderColumns of an answer. They are
+// empty for questions not answered.
+func (q Question) orderValues(answer exportAnswer, page Page) []string {
+	var values []string
+	if page.Randomize {
+		position := ""
+		if answer.position.Valid {
+			position = strconv.FormatInt(answer.position.Int64, 10)
+		}
+		values = append(values, position)
+	}
+	if q.Randomize {
+		for _, value := range q.presentedOrder() {
+			position := ""
+			if i := slices.Index(answer.order, value); i >= 0 {
+				position = strconv.Itoa(i + 1)
+			}
+			values = append(values, position)
+		}
+	}
+	return values
+}
+
+// questionnaireColumns names the answer and order columns of every question
+// of questionnaire, in the order questionnaireValues fills them.
+func questionnaireColumns(questionnaire Questionnaire) []string {
+	var columns []string
+	for _, wave := range []string{WAVE_PRE, WAVE_POST} {
+		for _, page := range questionnaire.Pages(wave) {
+			for _, question := range page.Questions {
+				columns = append(columns, question.exportColumns(wave)...)
+				columns = append(columns, question.orderColumns(wave, page)...)
+			}
+		}
+	}
+	return columns
+}
+
+// questionnaireValues returns the values of the questionnaireColumns of one
+// response, whose answers are looked up with answer.
+func questionnaireValues(questionnaire Questionnaire, answer func(wave string, questionID string) exportAnswer) []string {
+	var values []string
+	for _, wave := range []string{WAVE_PRE, WAVE_POST} {
+		for _, page := range questionnaire.Pages(wave) {
+			for _, question := range page.Questions {
+				a := answer(wave, question.ID)
+				values = append(values, question.exportValues(a.value)...)
+				values = append(values, question.orderValues(a, page)...)
+			}
+		}
+	}
+	return values
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// exportResponses writes a CSV row for every response to surveyID with the
+// answers to every question of its questionnaire.
+func exportResponses(w *csv.Writer, surveyID uuid.UUID) error {
+	var config SurveyConfig
+	err := config.Scan(surveyConfigQueryStmt.QueryRow(surveyID))
+	if err != nil {
+		return fmt.Errorf("failed to get survey config: %v", err)
+	}
+
+	type answerKey struct {
+		responseID uuid.UUID
+		wave       string
+		questionID string
+	}
+	answers := map[answerKey]exportAnswer{}
+	rows, err := exportAnswerStmt.Query(surveyID)
+	if err != nil {
+		return fmt.Errorf("failed to execute exportAnswerStmt: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key answerKey
+		var answer exportAnswer
+		err := rows.Scan(&key.responseID, &key.wave, &key.questionID, &answer.value, &answer.position, pq.Array(&answer.order))
+		if err != nil {
+			return err
+		}
+		answers[key] = answer
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	header := append(slices.Clone(EXPORT_COLUMNS), questionnaireColumns(config.Questionnaire)...)
+	if err := w.Write(header); err != nil {
+		return err
+	}
+
+	responses, err := exportResponseStmt.Query(surveyID)
+	if err != nil {
+		return fmt.Errorf("failed to execute exportResponseStmt: %v", err)
+	}
+	defer responses.Close()
+	for responses.Next() {
+		var id uuid.UUID
+		var responseID, cell, condition, exitStatus string
+		var innovateFirst bool
+		var startTime, preCompleteTime, completeTime *time.Time
+		err := responses.Scan(&id, &responseID, &cell, &condition, &innovateFirst, &startTime, &preCompleteTime, &completeTime, &exitStatus)
+		if err != nil {
+			return err
+		}
+		record := []string{
+			id.String(),
+			responseID,
+			cell,
+			condition,
+			strconv.FormatBool(innovateFirst),
+			formatTime(startTime),
+			formatTime(preCompleteTime),
+			formatTime(completeTime),
+			exitStatus,
+		}
+		record = append(record, questionnaireValues(config.Questionnaire, func(wave string, questionID string) exportAnswer {
+			return answers[answerKey{id, wave, questionID}]
+		})...)
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	if err := responses.Err(); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != os.Getenv("LUCIDHQ_API_KEY") {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	surveyID, err := uuid.Parse(r.URL.Query().Get("survey-id"))
+	if err != nil {
+		log.Printf("unable to parse survey-id %s: %v\n", r.URL.Query().Get("survey-id"), err)
+		http.Error(w, "invalid survey-id parameter", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", surveyID))
+	err = exportResponses(csv.NewWriter(w), surveyID)
+	if err != nil {
+		log.Printf("failed to export responses: %v\n", err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestQuestionnaireValuesMatchColumns(t *testing.T) {
+	questionnaire, err := loadQuestionnaire(QUESTIONNAIRE_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	randomized := false
+	for _, wave := range []string{WAVE_PRE, WAVE_POST} {
+		for _, page := range questionnaire.Pages(wave) {
+			for _, question := range page.Questions {
+				randomized = randomized || page.Randomize || question.Randomize
+			}
+		}
+	}
+	if !randomized {
+		t.Fatalf("%s randomizes nothing", QUESTIONNAIRE_FILE)
+	}
+
+	header := questionnaireColumns(questionnaire)
+	tests := map[string]func(wave string, questionID string) exportAnswer{
+		"unanswered": func(string, string) exportAnswer { return exportAnswer{} },
+		"answered": func(string, string) exportAnswer {
+			return exportAnswer{value: "x", position: sql.NullInt64{Int64: 1, Valid: true}, order: []string{"x"}}
+		},
+	}
+	for name, answer := range tests {
+		record := questionnaireValues(questionnaire, answer)
+		if len(header) != len(record) {
+			t.Errorf("%s: %d columns but %d values", name, len(header), len(record))
+		}
+	}
+}
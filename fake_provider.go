@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const FAKE_PROVIDER = "fake"
+
+const DEFAULT_FAKE_REPLY = "{{ .Model }} reply {{ .Call }} to: {{ .LastUserMessage }}"
+
+var errFakeInjected = errors.New("fake provider: injected error")
+
+// FakeConfig controls the replies, pacing and failures of the fake provider.
+// It is shared by every FakeProvider so that the call counter, and therefore
+// the script position and error injection, is deterministic per process.
+type FakeConfig struct {
+	// Replies are cycled through in order, one per stream. Each reply is a
+	// text/template executed with FakeReplyData.
+	Replies []*texttemplate.Template
+	// ChunkWords is the number of words sent per Recv.
+	ChunkWords int
+	// Latency is slept before every chunk.
+	Latency time.Duration
+	// FailEvery makes every nth stream fail. Zero disables error injection.
+	FailEvery int
+	// FailMidStream makes injected failures happen after the first chunk
+	// instead of when the stream is created.
+	FailMidStream bool
+
+	mu    sync.Mutex
+	calls int
+}
+
+// FakeReplyData is the data available to fake reply templates.
+type FakeReplyData struct {
+	Model           string
+	Call            int
+	Turn            int
+	LastUserMessage string
+}
+
+var fakeConfig = &FakeConfig{
+	Replies:    []*texttemplate.Template{texttemplate.Must(texttemplate.New("fake-reply").Parse(DEFAULT_FAKE_REPLY))},
+	ChunkWords: 1,
+}
+
+// loadFakeConfig reads the fake provider settings from the environment.
+//
+//	FAKE_LLM_SCRIPT        path to a JSON array of reply templates
+//	FAKE_LLM_CHUNK_WORDS   words per streamed chunk
+//	FAKE_LLM_LATENCY       delay before each chunk, e.g. "50ms"
+//	FAKE_LLM_FAIL_EVERY    fail every nth stream
+//	FAKE_LLM_FAIL_MID      "true" to fail after the first chunk
+func loadFakeConfig() (*FakeConfig, error) {
+	config := &FakeConfig{
+		Replies:    fakeConfig.Replies,
+		ChunkWords: 1,
+	}
+	if path := os.Getenv("FAKE_LLM_SCRIPT"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read FAKE_LLM_SCRIPT: %v", err)
+		}
+		var script []string
+		if err := json.Unmarshal(data, &script); err != nil {
+			return nil, fmt.Errorf("unable to decode FAKE_LLM_SCRIPT: %v", err)
+		}
+		if len(script) == 0 {
+			return nil, errors.New("FAKE_LLM_SCRIPT has no replies")
+		}
+		config.Replies = nil
+		for i, reply := range script {
+			tmpl, err := texttemplate.New(fmt.Sprintf("fake-reply-%d", i)).Parse(reply)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse fake reply %d: %v", i, err)
+			}
+			config.Replies = append(config.Replies, tmpl)
+		}
+	}
+	if param := os.Getenv("FAKE_LLM_CHUNK_WORDS"); param != "" {
+		chunkWords, err := strconv.Atoi(param)
+		if err != nil || chunkWords < 1 {
+			return nil, fmt.Errorf("invalid FAKE_LLM_CHUNK_WORDS %s", param)
+		}
+		config.ChunkWords = chunkWords
+	}
+	if param := os.Getenv("FAKE_LLM_LATENCY"); param != "" {
+		latency, err := time.ParseDuration(param)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FAKE_LLM_LATENCY %s: %v", param, err)
+		}
+		config.Latency = latency
+	}
+	if param := os.Getenv("FAKE_LLM_FAIL_EVERY"); param != "" {
+		failEvery, err := strconv.Atoi(param)
+		if err != nil || failEvery < 0 {
+			return nil, fmt.Errorf("invalid FAKE_LLM_FAIL_EVERY %s", param)
+		}
+		config.FailEvery = failEvery
+	}
+	config.FailMidStream = os.Getenv("FAKE_LLM_FAIL_MID") == "true"
+	return config, nil
+}
+
+// nextCall returns the 1-based index of the next stream.
+func (c *FakeConfig) nextCall() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	return c.calls
+}
+
+// FakeProvider streams scripted replies without calling an LLM.
+type FakeProvider struct {
+	config *FakeConfig
+	model  string
+}
+
+func (p *FakeProvider) Name() string {
+	return FAKE_PROVIDER
+}
+
+func (p *FakeProvider) Model() string {
+	return p.model
+}
+
+func (p *FakeProvider) CreateChatStream(ctx context.Context, req ChatRequest) (ChatStream, error) {
+	call := p.config.nextCall()
+	fail := p.config.FailEvery > 0 && call%p.config.FailEvery == 0
+	if fail && !p.config.FailMidStream {
+		return nil, errFakeInjected
+	}
+
+	data := FakeReplyData{
+		Model: p.model,
+		Call:  call,
+	}
+	var promptWords int
+	for _, msg := range req.Messages {
+		promptWords += len(strings.Fields(msg.Content))
+		if msg.Role == openai.ChatMessageRoleUser {
+			data.Turn++
+			data.LastUserMessage = msg.Content
+		}
+	}
+
+	var buf bytes.Buffer
+	reply := p.config.Replies[(call-1)%len(p.config.Replies)]
+	if err := reply.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("unable to execute fake reply: %v", err)
+	}
+
+	words := strings.SplitAfter(buf.String(), " ")
+	var chunks []string
+	for i := 0; i < len(words); i += p.config.ChunkWords {
+		end := min(i+p.config.ChunkWords, len(words))
+		chunks = append(chunks, strings.Join(words[i:end], ""))
+	}
+
+	return &fakeChatStream{
+		ctx:     ctx,
+		chunks:  chunks,
+		latency: p.config.Latency,
+		fail:    fail,
+		usage: Usage{
+			PromptTokens:     promptWords,
+			CompletionTokens: len(strings.Fields(buf.String())),
+		},
+	}, nil
+}
+
+type fakeChatStream struct {
+	ctx     context.Context
+	chunks  []string
+	sent    int
+	latency time.Duration
+	fail    bool
+	usage   Usage
+}
+
+func (s *fakeChatStream) Recv() (string, error) {
+	if s.fail && s.sent == 1 {
+		return "", errFakeInjected
+	}
+	if s.sent >= len(s.chunks) {
+		return "", io.EOF
+	}
+	if s.latency > 0 {
+		select {
+		case <-s.ctx.Done():
+			return "", s.ctx.Err()
+		case <-time.After(s.latency):
+		}
+	}
+	chunk := s.chunks[s.sent]
+	s.sent++
+	return chunk, nil
+}
+
+func (s *fakeChatStream) Usage() Usage {
+	return s.usage
+}
+
+func (s *fakeChatStream) FinishReason() string {
+	if s.sent < len(s.chunks) {
+		return ""
+	}
+	return "stop"
+}
+
+func (s *fakeChatStream) Close() error {
+	return nil
+}
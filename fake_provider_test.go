@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	texttemplate "text/template"
+
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+)
+
+const TEST_FAKE_REPLY = "{{ .Model }} answers {{ .LastUserMessage }}"
+
+// newTestFakeConfig returns a fake provider config streaming TEST_FAKE_REPLY
+// one word at a time.
+func newTestFakeConfig() *FakeConfig {
+	return &FakeConfig{
+		Replies:    []*texttemplate.Template{texttemplate.Must(texttemplate.New("test-reply").Parse(TEST_FAKE_REPLY))},
+		ChunkWords: 1,
+	}
+}
+
+// streamFakeReply streams the reply of the fake provider with config to
+// userMsg through the chat stream and returns it with the events sent.
+func streamFakeReply(config *FakeConfig, model string, userMsg string) (string, string, error) {
+	text, events, _, err := streamFakeReplyLive(config, model, userMsg, true)
+	return text, events, err
+}
+
+// streamFakeReplyLive is streamFakeReply with the reply only shown once
+// complete unless live is set. It also returns the generation metadata.
+func streamFakeReplyLive(config *FakeConfig, model string, userMsg string, live bool) (string, string, GenerationMeta, error) {
+	provider := &FakeProvider{config: config, model: model}
+	stream, err := provider.CreateChatStream(context.Background(), ChatRequest{
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: "system prompt"},
+			{Role: openai.ChatMessageRoleUser, Content: userMsg},
+		},
+	})
+	meta := GenerationMeta{Provider: provider.Name(), Model: provider.Model()}
+	if err != nil {
+		return "", "", meta, err
+	}
+	defer stream.Close()
+
+	w := httptest.NewRecorder()
+	text, err := streamOpenaiResponse(w, stream, ChatMessage{QuestionID: uuid.New(), Role: "InnovateBot"}, live, &meta)
+	return text, w.Body.String(), meta, err
+}
+
+func TestFakeProviderStreamsReply(t *testing.T) {
+	text, events, err := streamFakeReply(newTestFakeConfig(), "fake-model", "why?")
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if want := "fake-model answers why?"; text != want {
+		t.Errorf("text = %q, want %q", text, want)
+	}
+	if !strings.Contains(events, "-InnovateBot\ndata: ") {
+		t.Errorf("no InnovateBot event in %q", events)
+	}
+	// Each of the three words is streamed, then the whole reply.
+	if got := strings.Count(events, "event: "); got != 4 {
+		t.Errorf("got %d events, want 4", got)
+	}
+}
+
+func TestFakeProviderRecordsUsage(t *testing.T) {
+	_, _, meta, err := streamFakeReplyLive(newTestFakeConfig(), "fake-model", "why?", true)
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	// The fake provider counts words as tokens.
+	if meta.PromptTokens != 3 || meta.CompletionTokens != 3 {
+		t.Errorf("got %d prompt and %d completion tokens, want 3 and 3", meta.PromptTokens, meta.CompletionTokens)
+	}
+	if meta.FinishReason != "stop" {
+		t.Errorf("finish reason = %q, want stop", meta.FinishReason)
+	}
+}
+
+func TestFakeProviderWithoutStreaming(t *testing.T) {
+	text, events, _, err := streamFakeReplyLive(newTestFakeConfig(), "fake-model", "why?", false)
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if got := strings.Count(events, "event: "); got != 1 {
+		t.Errorf("got %d events, want only the complete reply", got)
+	}
+	if !strings.Contains(events, text) {
+		t.Errorf("events %q do not contain the reply %q", events, text)
+	}
+}
+
+func TestFakeProviderCyclesReplies(t *testing.T) {
+	config := newTestFakeConfig()
+	config.Replies = append(config.Replies, texttemplate.Must(texttemplate.New("second").Parse("reply {{ .Call }}")))
+	want := []string{"fake-model answers why?", "reply 2", "fake-model answers why?"}
+	for i, reply := range want {
+		text, _, err := streamFakeReply(config, "fake-model", "why?")
+		if err != nil {
+			t.Fatalf("stream %d: %v", i+1, err)
+		}
+		if text != reply {
+			t.Errorf("stream %d = %q, want %q", i+1, text, reply)
+		}
+	}
+}
+
+func TestFakeProviderInjectedFailure(t *testing.T) {
+	for _, midStream := range []bool{false, true} {
+		config := newTestFakeConfig()
+		config.FailEvery = 2
+		config.FailMidStream = midStream
+		if _, _, err := streamFakeReply(config, "fake-model", "why?"); err != nil {
+			t.Fatalf("first stream: %v", err)
+		}
+		_, _, err := streamFakeReply(config, "fake-model", "why?")
+		if err != errFakeInjected {
+			t.Errorf("mid stream %t: error = %v, want the injected failure", midStream, err)
+		}
+	}
+}
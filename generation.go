@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var REASONING_EFFORTS = []string{"", "low", "medium", "high"}
+
+// GenerationSettings are the model parameters used for a bot reply. Unset
+// fields fall back to the less specific level they are merged over.
+type GenerationSettings struct {
+	Model           string   `json:"model,omitempty"`
+	Temperature     *float32 `json:"temperature,omitempty"`
+	ReasoningEffort string   `json:"reasoning_effort,omitempty"`
+	MaxTokens       int      `json:"max_tokens,omitempty"`
+	// Stream controls whether the reply is shown to the participant while it
+	// is being generated or only once it is complete.
+	Stream *bool `json:"stream,omitempty"`
+}
+
+// Merge returns gs with every field that is set in override replaced.
+func (gs GenerationSettings) Merge(override GenerationSettings) GenerationSettings {
+	if override.Model != "" {
+		gs.Model = override.Model
+	}
+	if override.Temperature != nil {
+		gs.Temperature = override.Temperature
+	}
+	if override.ReasoningEffort != "" {
+		gs.ReasoningEffort = override.ReasoningEffort
+	}
+	if override.MaxTokens != 0 {
+		gs.MaxTokens = override.MaxTokens
+	}
+	if override.Stream != nil {
+		gs.Stream = override.Stream
+	}
+	return gs
+}
+
+// Streaming reports whether the reply should be streamed, which is the default.
+func (gs GenerationSettings) Streaming() bool {
+	return gs.Stream == nil || *gs.Stream
+}
+
+func (gs GenerationSettings) Validate() error {
+	if gs.Temperature != nil && (*gs.Temperature < 0 || *gs.Temperature > 2) {
+		return fmt.Errorf("temperature %v is outside of [0, 2]", *gs.Temperature)
+	}
+	if gs.MaxTokens < 0 {
+		return fmt.Errorf("max tokens %d is negative", gs.MaxTokens)
+	}
+	for _, effort := range REASONING_EFFORTS {
+		if gs.ReasoningEffort == effort {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown reasoning effort %q", gs.ReasoningEffort)
+}
+
+// positionSettings returns the provider defaults for the first (position 0)
+// or second speaker of a question.
+func positionSettings(provider string, position int) GenerationSettings {
+	defaults := PROVIDER_DEFAULTS[provider]
+	if position == 0 {
+		return GenerationSettings{
+			Model:           defaults.FirstModel,
+			ReasoningEffort: defaults.FirstReasoningEffort,
+		}
+	}
+	return GenerationSettings{Model: defaults.SecondModel}
+}
+
+// parseGenerationSettings reads survey level generation settings from the
+// deploy form.
+func parseGenerationSettings(form func(string) string) (GenerationSettings, error) {
+	gs := GenerationSettings{
+		Model:           form("model"),
+		ReasoningEffort: form("reasoningEffort"),
+	}
+	if param := form("temperature"); param != "" {
+		temperature, err := strconv.ParseFloat(param, 32)
+		if err != nil {
+			return gs, fmt.Errorf("invalid temperature %s: %v", param, err)
+		}
+		t := float32(temperature)
+		gs.Temperature = &t
+	}
+	if param := form("maxTokens"); param != "" {
+		maxTokens, err := strconv.Atoi(param)
+		if err != nil {
+			return gs, fmt.Errorf("invalid maxTokens %s: %v", param, err)
+		}
+		gs.MaxTokens = maxTokens
+	}
+	if param := form("stream"); param != "" {
+		stream, err := strconv.ParseBool(param)
+		if err != nil {
+			return gs, fmt.Errorf("invalid stream %s: %v", param, err)
+		}
+		gs.Stream = &stream
+	}
+	return gs, gs.Validate()
+}
+
+// parseBotOverrides decodes the per bot settings JSON object, keyed by bot name.
+func parseBotOverrides(param string) (map[string]GenerationSettings, error) {
+	overrides := map[string]GenerationSettings{}
+	if param == "" {
+		return overrides, nil
+	}
+	if err := json.Unmarshal([]byte(param), &overrides); err != nil {
+		return nil, fmt.Errorf("invalid botSettings: %v", err)
+	}
+	for name, gs := range overrides {
+		if err := gs.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid botSettings for %s: %v", name, err)
+		}
+	}
+	return overrides, nil
+}
+
+// scanGeneration fills the nullable generation columns of a survey row.
+func scanGeneration(gs *GenerationSettings, model sql.NullString, temperature sql.NullFloat64,
+	reasoningEffort sql.NullString, maxTokens sql.NullInt64, stream sql.NullBool) {
+	gs.Model = model.String
+	gs.ReasoningEffort = reasoningEffort.String
+	gs.MaxTokens = int(maxTokens.Int64)
+	if temperature.Valid {
+		t := float32(temperature.Float64)
+		gs.Temperature = &t
+	}
+	if stream.Valid {
+		gs.Stream = &stream.Bool
+	}
+}
+
+// GenerationMeta describes how a single bot reply was produced. It is stored
+// with the reply so odd transcripts can be explained after the fact.
+type GenerationMeta struct {
+	Provider           string `json:"provider"`
+	Model              string `json:"model"`
+	PromptVersion      string `json:"prompt_version"`
+	FinishReason       string `json:"finish_reason"`
+	PromptTokens       int    `json:"prompt_tokens"`
+	CompletionTokens   int    `json:"completion_tokens"`
+	ReasoningTokens    int    `json:"reasoning_tokens"`
+	TimeToFirstTokenMS int64  `json:"time_to_first_token_ms"`
+	LatencyMS          int64  `json:"latency_ms"`
+
+	start time.Time
+}
+
+// newGenerationMeta starts the clock for a reply. It should be called right
+// before the completion request is made.
+func newGenerationMeta(provider Provider, prompt Prompt) GenerationMeta {
+	return GenerationMeta{
+		Provider:      provider.Name(),
+		Model:         provider.Model(),
+		PromptVersion: prompt.Version,
+		start:         time.Now(),
+	}
+}
+
+func (meta *GenerationMeta) firstToken() {
+	if meta.TimeToFirstTokenMS == 0 {
+		meta.TimeToFirstTokenMS = time.Since(meta.start).Milliseconds()
+	}
+}
+
+// finish records the totals once the stream has returned io.EOF.
+func (meta *GenerationMeta) finish(stream ChatStream) {
+	usage := stream.Usage()
+	meta.PromptTokens = usage.PromptTokens
+	meta.CompletionTokens = usage.CompletionTokens
+	meta.ReasoningTokens = usage.ReasoningTokens
+	meta.FinishReason = stream.FinishReason()
+	meta.LatencyMS = time.Since(meta.start).Milliseconds()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/loganamcnichols/ai-debate/lucid"
+)
+
+// Lifecycle actions recorded in survey_status.
+const (
+	ACTION_DEPLOY   = "deploy"
+	ACTION_PAUSE    = "pause"
+	ACTION_RESUME   = "resume"
+	ACTION_CLOSE    = "close"
+	ACTION_QUANTITY = "quantity"
+	ACTION_CPI      = "cpi"
+)
+
+// DEFAULT_CPI_USD is the cost per interview surveys are deployed with.
+const DEFAULT_CPI_USD = 0.5
+
+var (
+	surveyLucidIDStmt      *sql.Stmt
+	surveyStatusInsertStmt *sql.Stmt
+	surveyStatusQueryStmt  *sql.Stmt
+)
+
+// SurveyStatus is an entry of the status history of a survey. Only the
+// fields the action changed are set. Error is set when Lucid rejected it.
+type SurveyStatus struct {
+	Action     string    `json:"action"`
+	Status     *string   `json:"status,omitempty"`
+	Quantity   *int      `json:"quantity,omitempty"`
+	CPI        *float32  `json:"cpi,omitempty"`
+	Error      *string   `json:"error,omitempty"`
+	CreateTime time.Time `json:"create_time"`
+}
+
+// update is the Lucid update that applies s.
+func (s SurveyStatus) update() lucid.SurveyUpdate {
+	return lucid.SurveyUpdate{Status: s.Status, Quantity: s.Quantity, SurveyCPIUSD: s.CPI}
+}
+
+// recordStatus adds s to the history of surveyID. tx may be nil.
+func recordStatus(tx *sql.Tx, surveyID uuid.UUID, s SurveyStatus) error {
+	stmt := surveyStatusInsertStmt
+	if tx != nil {
+		stmt = tx.Stmt(stmt)
+	}
+	_, err := stmt.Exec(surveyID, s.Action, s.Status, s.Quantity, s.CPI, s.Error)
+	if err != nil {
+		return fmt.Errorf("failed to execute surveyStatusInsertStmt: %v", err)
+	}
+	return nil
+}
+
+// parseLifecycleAction reads the change of action from the request
+// parameters.
+func parseLifecycleAction(action string, r *http.Request) (SurveyStatus, error) {
+	s := SurveyStatus{Action: action}
+	status := func(status string) *string { return &status }
+	switch action {
+	case ACTION_PAUSE:
+		s.Status = status(lucid.STATUS_PAUSED)
+	case ACTION_RESUME:
+		s.Status = status(lucid.STATUS_LIVE)
+	case ACTION_CLOSE:
+		s.Status = status(lucid.STATUS_COMPLETE)
+	case ACTION_QUANTITY:
+		quantity, err := strconv.Atoi(r.FormValue("quantity"))
+		if err != nil || quantity <= 0 {
+			return s, fmt.Errorf("invalid quantity %q", r.FormValue("quantity"))
+		}
+		s.Quantity = &quantity
+	case ACTION_CPI:
+		cpi, err := strconv.ParseFloat(r.FormValue("cpi"), 32)
+		if err != nil || cpi <= 0 {
+			return s, fmt.Errorf("invalid cpi %q", r.FormValue("cpi"))
+		}
+		cpi32 := float32(cpi)
+		s.CPI = &cpi32
+	default:
+		return s, fmt.Errorf("unknown action %q", action)
+	}
+	return s, nil
+}
+
+// applyLifecycleAction sends s to Lucid for surveyID and records it, with
+// the error if Lucid rejected it.
+func applyLifecycleAction(ctx context.Context, surveyID uuid.UUID, s SurveyStatus) (SurveyStatus, error) {
+	var lucidID sql.NullInt64
+	err := surveyLucidIDStmt.QueryRow(surveyID).Scan(&lucidID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, fmt.Errorf("survey %s not found", surveyID)
+	}
+	if err != nil {
+		return s, fmt.Errorf("failed to execute surveyLucidIDStmt: %v", err)
+	}
+	if !lucidID.Valid {
+		return s, fmt.Errorf("survey %s was not launched on Lucid", surveyID)
+	}
+
+	// Each admin request is one operation, so it gets its own key.
+	lucidErr := lucidClient.UpdateSurvey(ctx, int(lucidID.Int64), s.update(), uuid.NewString())
+	if lucidErr != nil {
+		message := lucidErr.Error()
+		s.Error = &message
+	}
+	s.CreateTime = time.Now()
+	if err := recordStatus(nil, surveyID, s); err != nil {
+		return s, err
+	}
+	return s, lucidErr
+}
+
+// handleLifecycle changes the Lucid survey of the survey in the survey-id
+// parameter. The action is the last path segment: pause, resume, close,
+// quantity with a quantity parameter or cpi with a cpi parameter. The quota
+// counts were split from the quantity the survey was deployed with, so the
+// quantity of a survey with quotas cannot be changed.
+func handleLifecycle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != os.Getenv("LUCIDHQ_API_KEY") {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	surveyID, err := uuid.Parse(r.URL.Query().Get("survey-id"))
+	if err != nil {
+		log.Printf("unable to parse survey-id %s: %v\n", r.URL.Query().Get("survey-id"), err)
+		http.Error(w, "invalid survey-id parameter", http.StatusBadRequest)
+		return
+	}
+	s, err := parseLifecycleAction(mux.Vars(r)["action"], r)
+	if err != nil {
+		log.Printf("received invalid lifecycle action: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.Quantity != nil {
+		quotas, err := quotaFill(surveyID)
+		if err != nil {
+			log.Printf("failed to read quotas: %v\n", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if len(quotas) > 0 {
+			http.Error(w, "the quantity of a survey with quotas cannot be changed", http.StatusConflict)
+			return
+		}
+	}
+	s, err = applyLifecycleAction(r.Context(), surveyID, s)
+	if err != nil {
+		log.Printf("unable to %s survey %s: %v\n", s.Action, surveyID, err)
+		status := http.StatusInternalServerError
+		if s.Error != nil {
+			status = http.StatusBadGateway
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(s)
+	if err != nil {
+		log.Printf("unable to encode survey status: %v\n", err)
+	}
+}
+
+func statusHistory(surveyID uuid.UUID) ([]SurveyStatus, error) {
+	rows, err := surveyStatusQueryStmt.Query(surveyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute surveyStatusQueryStmt: %v", err)
+	}
+	defer rows.Close()
+
+	history := []SurveyStatus{}
+	for rows.Next() {
+		var s SurveyStatus
+		if err := rows.Scan(&s.Action, &s.Status, &s.Quantity, &s.CPI, &s.Error, &s.CreateTime); err != nil {
+			return nil, err
+		}
+		history = append(history, s)
+	}
+	return history, rows.Err()
+}
+
+func handleStatusHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != os.Getenv("LUCIDHQ_API_KEY") {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	surveyID, err := uuid.Parse(r.URL.Query().Get("survey-id"))
+	if err != nil {
+		log.Printf("unable to parse survey-id %s: %v\n", r.URL.Query().Get("survey-id"), err)
+		http.Error(w, "invalid survey-id parameter", http.StatusBadRequest)
+		return
+	}
+	history, err := statusHistory(surveyID)
+	if err != nil {
+		log.Printf("failed to read status history: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(history)
+	if err != nil {
+		log.Printf("unable to encode status history: %v\n", err)
+	}
+}
@@ -0,0 +1,179 @@
+// Package lucid is a client for the parts of the Lucid marketplace API used
+// to field surveys.
+package lucid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_BASE_URL    = "https://api.samplicio.us"
+	DEFAULT_MAX_RETRIES = 3
+	DEFAULT_BACKOFF     = 500 * time.Millisecond
+	DEFAULT_TIMEOUT     = 30 * time.Second
+)
+
+// Client sends authenticated requests to the Lucid API. Requests that fail
+// with a network error, 429 or a 5xx status are retried with exponential
+// backoff.
+type Client struct {
+	HTTPClient *http.Client
+	BaseURL    *url.URL
+	APIKey     string
+	// MaxRetries is the number of times a failed request is retried.
+	MaxRetries int
+	// Backoff is the wait before the first retry. It doubles on every
+	// retry unless the response sets Retry-After.
+	Backoff time.Duration
+}
+
+// New returns a client for the production API.
+func New(apiKey string) *Client {
+	baseURL, _ := url.Parse(DEFAULT_BASE_URL)
+	return &Client{
+		HTTPClient: &http.Client{Timeout: DEFAULT_TIMEOUT},
+		BaseURL:    baseURL,
+		APIKey:     apiKey,
+		MaxRetries: DEFAULT_MAX_RETRIES,
+		Backoff:    DEFAULT_BACKOFF,
+	}
+}
+
+// Error is a response from the API with a status other than 2xx.
+type Error struct {
+	Method     string
+	URL        string
+	StatusCode int
+	// Message is the error reported in the body, or the body itself when
+	// it cannot be decoded.
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("lucid %s %s: %d %s", e.Method, e.URL, e.StatusCode, e.Message)
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *Error) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// decodeError reads the error in the body of res. Version 1 endpoints
+// report errors in Errors and version 2 ones in errors or message, which
+// encoding/json matches either way.
+func decodeError(req *http.Request, res *http.Response) *Error {
+	e := &Error{Method: req.Method, URL: req.URL.String(), StatusCode: res.StatusCode}
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+	if err != nil {
+		e.Message = fmt.Sprintf("unable to read body: %v", err)
+		return e
+	}
+	var decoded struct {
+		Message string `json:"message"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &decoded) == nil {
+		var messages []string
+		if decoded.Message != "" {
+			messages = append(messages, decoded.Message)
+		}
+		for _, e := range decoded.Errors {
+			messages = append(messages, e.Message)
+		}
+		e.Message = strings.Join(messages, "; ")
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(res.StatusCode)
+	}
+	return e
+}
+
+// do sends a request to path under the base URL with body encoded as JSON
+// and decodes the response into out unless it is nil. idempotencyKey is sent
+// with every attempt so the API can drop the repeats of a request that
+// succeeded without the response arriving.
+func (c *Client) do(ctx context.Context, method string, path string, idempotencyKey string, body any, out any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("unable to marshal %s %s body: %v", method, path, err)
+		}
+	}
+	endpoint := c.BaseURL.JoinPath(path)
+
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, endpoint.String(), bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("unable to create %s %s request: %v", method, path, err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", c.APIKey)
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+
+		wait := backoff
+		retry, err := c.send(req, out, &wait)
+		if err == nil {
+			return nil
+		}
+		if !retry {
+			return err
+		}
+		if attempt >= c.MaxRetries {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w, last error: %v", ctx.Err(), err)
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// send makes one attempt of req and reports whether a failure may be
+// retried. A Retry-After header on a failed response replaces the wait
+// before the next attempt.
+func (c *Client) send(req *http.Request, out any, wait *time.Duration) (bool, error) {
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return req.Context().Err() == nil, fmt.Errorf("lucid %s %s: %v", req.Method, req.URL, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			*wait = time.Duration(seconds) * time.Second
+		}
+		apiErr := decodeError(req, res)
+		return apiErr.Temporary(), apiErr
+	}
+	if out == nil {
+		io.Copy(io.Discard, res.Body)
+		return false, nil
+	}
+	// The request succeeded, so it is not retried even if the response
+	// cannot be decoded.
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return false, fmt.Errorf("unable to decode lucid %s %s response: %v", req.Method, req.URL, err)
+	}
+	return false, nil
+}
@@ -0,0 +1,370 @@
+// Package lucidtest is an in-memory stand-in for the Lucid marketplace API,
+// so surveys can be deployed without touching samplicio.us.
+package lucidtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/loganamcnichols/ai-debate/lucid"
+)
+
+// FIRST_SURVEY_ID is the ID given to the first survey created.
+const FIRST_SURVEY_ID = 1000
+
+var STATUSES = []string{lucid.STATUS_AWARDED, lucid.STATUS_LIVE, lucid.STATUS_PAUSED, lucid.STATUS_COMPLETE, lucid.STATUS_ARCHIVED}
+
+// Call is a request received by the handler.
+type Call struct {
+	Method         string
+	Path           string
+	IdempotencyKey string
+	Body           json.RawMessage
+	// StatusCode is the status of the response.
+	StatusCode int
+	// Replayed is set when the response was repeated for an idempotency
+	// key seen before, without applying the request again.
+	Replayed bool
+}
+
+// Survey is the state of a survey created through the handler.
+type Survey struct {
+	lucid.SurveyRequest
+	ID                int
+	SID               string
+	Qualifications    []lucid.Qualification
+	Quotas            []lucid.Quota
+	ExchangeTemplates []int
+}
+
+type failure struct {
+	method string
+	path   string
+	status int
+	times  int
+}
+
+type response struct {
+	status int
+	body   []byte
+}
+
+// Handler serves the survey, qualification, exchange template and status
+// endpoints used by the lucid package.
+type Handler struct {
+	// APIKey is the Authorization header requests must carry.
+	APIKey string
+	// Logger, when set, logs every call.
+	Logger *log.Logger
+
+	router *mux.Router
+
+	mu       sync.Mutex
+	nextID   int
+	quotaID  int
+	surveys  map[int]*Survey
+	calls    []Call
+	failures []failure
+	replies  map[string]response
+}
+
+func NewHandler(apiKey string) *Handler {
+	h := &Handler{
+		APIKey:  apiKey,
+		nextID:  FIRST_SURVEY_ID,
+		surveys: map[int]*Survey{},
+		replies: map[string]response{},
+	}
+	h.router = mux.NewRouter()
+	h.router.HandleFunc("/"+lucid.SURVEYS_PATH, h.createSurvey).Methods("POST")
+	h.router.HandleFunc("/"+lucid.SURVEYS_PATH+"/{id:[0-9]+}", h.getSurvey).Methods("GET")
+	h.router.HandleFunc("/"+lucid.SURVEYS_PATH+"/{id:[0-9]+}", h.updateSurvey).Methods("PATCH")
+	h.router.HandleFunc("/"+lucid.QUALIFICATIONS_PATH+"/{id:[0-9]+}", h.addQualification).Methods("POST")
+	h.router.HandleFunc("/"+lucid.QUOTAS_PATH+"/{id:[0-9]+}", h.addQuota).Methods("POST")
+	h.router.HandleFunc("/"+lucid.EXCHANGE_TEMPLATES_PATH+"/{id:[0-9]+}/{template:[0-9]+}", h.applyExchangeTemplate).Methods("POST")
+	return h
+}
+
+// Fail makes the next times requests to method and path fail with status.
+func (h *Handler) Fail(method string, path string, status int, times int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = append(h.failures, failure{method: method, path: path, status: status, times: times})
+}
+
+// Calls returns the requests received so far.
+func (h *Handler) Calls() []Call {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.calls)
+}
+
+// Survey returns a copy of the survey with id.
+func (h *Handler) Survey(id int) (Survey, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	survey, ok := h.surveys[id]
+	if !ok {
+		return Survey{}, false
+	}
+	return *survey, true
+}
+
+// ServeHTTP handles one request. Requests are served one at a time, so the
+// state the endpoints see is the same as the order of Calls.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	call := Call{
+		Method:         r.Method,
+		Path:           r.URL.Path,
+		IdempotencyKey: r.Header.Get("Idempotency-Key"),
+		Body:           body,
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	defer func() {
+		h.calls = append(h.calls, call)
+		if h.Logger != nil {
+			h.Logger.Printf("%s %s key=%q status=%d replayed=%t %s", call.Method, call.Path, call.IdempotencyKey, call.StatusCode, call.Replayed, call.Body)
+		}
+	}()
+
+	rec := httptest.NewRecorder()
+	replyKey := call.Method + " " + call.Path + " " + call.IdempotencyKey
+	if r.Header.Get("Authorization") != h.APIKey {
+		writeError(rec, http.StatusUnauthorized, "invalid api key")
+	} else if reply, ok := h.replies[replyKey]; ok && call.IdempotencyKey != "" {
+		call.Replayed = true
+		rec.WriteHeader(reply.status)
+		rec.Write(reply.body)
+	} else if status := h.injectedFailure(r); status != 0 {
+		writeError(rec, status, "injected failure")
+	} else {
+		h.router.ServeHTTP(rec, r)
+		// Only successes are remembered, so a request that failed can
+		// be retried with the same key.
+		if call.IdempotencyKey != "" && rec.Code < 300 {
+			h.replies[replyKey] = response{status: rec.Code, body: rec.Body.Bytes()}
+		}
+	}
+
+	call.StatusCode = rec.Code
+	for key, values := range rec.Header() {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(rec.Code)
+	w.Write(rec.Body.Bytes())
+}
+
+// injectedFailure returns the status of the first failure set with Fail
+// that matches r, or zero.
+func (h *Handler) injectedFailure(r *http.Request) int {
+	for i, f := range h.failures {
+		if f.method == r.Method && f.path == r.URL.Path {
+			h.failures[i].times--
+			if h.failures[i].times <= 0 {
+				h.failures = slices.Delete(h.failures, i, i+1)
+			}
+			return f.status
+		}
+	}
+	return 0
+}
+
+func (h *Handler) createSurvey(w http.ResponseWriter, r *http.Request) {
+	var req lucid.SurveyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid survey: %v", err))
+		return
+	}
+	if req.Name == "" || req.Quantity <= 0 || req.LiveURL == "" {
+		writeError(w, http.StatusUnprocessableEntity, "name, quantity and live_url are required")
+		return
+	}
+	if req.Status == "" {
+		req.Status = lucid.STATUS_AWARDED
+	}
+	survey := &Survey{SurveyRequest: req, ID: h.nextID, SID: uuid.NewString()}
+	h.nextID++
+	h.surveys[survey.ID] = survey
+	writeJSON(w, http.StatusCreated, survey.summary())
+}
+
+func (h *Handler) getSurvey(w http.ResponseWriter, r *http.Request) {
+	survey := h.survey(w, r)
+	if survey == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, survey.summary())
+}
+
+func (h *Handler) updateSurvey(w http.ResponseWriter, r *http.Request) {
+	survey := h.survey(w, r)
+	if survey == nil {
+		return
+	}
+	var update lucid.SurveyUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid update: %v", err))
+		return
+	}
+	if update.Status != nil && !slices.Contains(STATUSES, *update.Status) {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("invalid status %q", *update.Status))
+		return
+	}
+	// Like the marketplace, surveys that have closed cannot be changed.
+	if survey.Status == lucid.STATUS_COMPLETE || survey.Status == lucid.STATUS_ARCHIVED {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("survey %d is %s", survey.ID, survey.Status))
+		return
+	}
+	if (update.Quantity != nil && *update.Quantity <= 0) || (update.SurveyCPIUSD != nil && *update.SurveyCPIUSD <= 0) {
+		writeError(w, http.StatusUnprocessableEntity, "quantity and survey_cpi_usd must be positive")
+		return
+	}
+	if update.Status != nil {
+		survey.Status = *update.Status
+	}
+	if update.Quantity != nil {
+		survey.Quantity = *update.Quantity
+	}
+	if update.SurveyCPIUSD != nil {
+		survey.SurveyCPIUSD = *update.SurveyCPIUSD
+	}
+	writeJSON(w, http.StatusOK, survey.summary())
+}
+
+func (h *Handler) addQualification(w http.ResponseWriter, r *http.Request) {
+	survey := h.survey(w, r)
+	if survey == nil {
+		return
+	}
+	var qualification lucid.Qualification
+	if err := json.NewDecoder(r.Body).Decode(&qualification); err != nil {
+		writeV1Error(w, http.StatusBadRequest, fmt.Sprintf("invalid qualification: %v", err))
+		return
+	}
+	if qualification.Name == "" || qualification.QuestionID == 0 || qualification.LogicalOperator == "" || len(qualification.PreCodes) == 0 {
+		writeV1Error(w, http.StatusBadRequest, "Name, QuestionID, LogicalOperator and PreCodes are required")
+		return
+	}
+	survey.Qualifications = append(survey.Qualifications, qualification)
+	writeJSON(w, http.StatusOK, map[string]any{"ApiResult": 0, "Qualification": qualification})
+}
+
+func (h *Handler) addQuota(w http.ResponseWriter, r *http.Request) {
+	survey := h.survey(w, r)
+	if survey == nil {
+		return
+	}
+	var quota lucid.Quota
+	if err := json.NewDecoder(r.Body).Decode(&quota); err != nil {
+		writeV1Error(w, http.StatusBadRequest, fmt.Sprintf("invalid quota: %v", err))
+		return
+	}
+	if quota.Name == "" || quota.Quota <= 0 || len(quota.Conditions) == 0 {
+		writeV1Error(w, http.StatusBadRequest, "Name, Quota and Conditions are required")
+		return
+	}
+	for _, condition := range quota.Conditions {
+		if !slices.ContainsFunc(survey.Qualifications, func(q lucid.Qualification) bool { return q.QuestionID == condition.QuestionID }) {
+			writeV1Error(w, http.StatusBadRequest, fmt.Sprintf("question %d is not a qualification of the survey", condition.QuestionID))
+			return
+		}
+	}
+	h.quotaID++
+	quota.ID = h.quotaID
+	survey.Quotas = append(survey.Quotas, quota)
+	writeJSON(w, http.StatusOK, map[string]any{"ApiResult": 0, "Quota": quota})
+}
+
+func (h *Handler) applyExchangeTemplate(w http.ResponseWriter, r *http.Request) {
+	survey := h.survey(w, r)
+	if survey == nil {
+		return
+	}
+	templateID, _ := strconv.Atoi(mux.Vars(r)["template"])
+	survey.ExchangeTemplates = append(survey.ExchangeTemplates, templateID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// survey returns the survey in the path, writing a 404 if there is none.
+func (h *Handler) survey(w http.ResponseWriter, r *http.Request) *Survey {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	survey, ok := h.surveys[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("survey %d not found", id))
+		return nil
+	}
+	return survey
+}
+
+func (s *Survey) summary() map[string]any {
+	return map[string]any{
+		"id":             s.ID,
+		"sid":            s.SID,
+		"name":           s.Name,
+		"status":         s.Status,
+		"quantity":       s.Quantity,
+		"survey_cpi_usd": s.SurveyCPIUSD,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError writes an error in the format of the version 2 endpoints.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]any{
+		"errors": []map[string]string{{"message": message}},
+	})
+}
+
+// writeV1Error writes an error in the format of the version 1 endpoints.
+func writeV1Error(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]any{
+		"ApiResult": 1,
+		"Errors":    []map[string]string{{"Message": message}},
+	})
+}
+
+// Server runs a Handler on a local port.
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// NewServer starts a server accepting apiKey. Call Close when done.
+func NewServer(apiKey string) *Server {
+	h := NewHandler(apiKey)
+	return &Server{Server: httptest.NewServer(h), Handler: h}
+}
+
+// LucidClient returns a client for the server that retries without delay.
+func (s *Server) LucidClient() *lucid.Client {
+	c := lucid.New(s.APIKey)
+	c.BaseURL, _ = url.Parse(s.URL)
+	c.HTTPClient = s.Server.Client()
+	c.Backoff = time.Millisecond
+	return c
+}
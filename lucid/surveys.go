@@ -0,0 +1,163 @@
+package lucid
+
+import (
+	"context"
+	"fmt"
+)
+
+// Paths of the endpoints under the base URL. Qualifications and quotas are
+// created through the version 1 endpoints, which take the survey ID as the
+// last path segment.
+const (
+	SURVEYS_PATH            = "demand/v2-beta/surveys"
+	QUALIFICATIONS_PATH     = "Demand/v1/SurveyQualifications/Create"
+	QUOTAS_PATH             = "Demand/v1/SurveyQuotas/Create"
+	EXCHANGE_TEMPLATES_PATH = "ExchangeTemplates/ApplyToSurvey"
+)
+
+// Survey statuses.
+const (
+	STATUS_AWARDED  = "awarded"
+	STATUS_LIVE     = "live"
+	STATUS_PAUSED   = "paused"
+	STATUS_COMPLETE = "complete"
+	STATUS_ARCHIVED = "archived"
+)
+
+type QuantityType string
+
+const (
+	PRESCREENS QuantityType = "prescreens"
+	COMPLETES  QuantityType = "completes"
+)
+
+type SurveyRequest struct {
+	BusinessUnitID int          `json:"business_unit_id"`
+	Locale         string       `json:"locale"`
+	Name           string       `json:"name"`
+	ProjectID      int          `json:"project_id"`
+	CollectsPII    bool         `json:"collects_pii"`
+	LiveURL        string       `json:"live_url"`
+	Quantity       int          `json:"quantity"`
+	QuantityType   QuantityType `json:"quantity_calc_type"`
+	Status         string       `json:"status"`
+	TestURL        string       `json:"test_url"`
+	SurveyCPIUSD   float32      `json:"survey_cpi_usd"`
+	StudyType      string       `json:"study_type"`
+	Industry       string       `json:"industry"`
+	CompletionRate float32      `json:"expected_incidence_rate"`
+	SurveyMinutes  int          `json:"expected_completion_loi"`
+}
+
+// Survey identifies a survey created in the marketplace.
+type Survey struct {
+	ID  int    `json:"id"`
+	SID string `json:"sid"`
+}
+
+// LOGICAL_OR qualifies respondents whose answer is any of the precodes.
+const LOGICAL_OR = "OR"
+
+// Qualification limits a survey to respondents with one of PreCodes as the
+// answer to a Lucid standard question, and passes the answer to the survey
+// link. Like the other version 1 types, it is sent with the field names of
+// the API.
+type Qualification struct {
+	Name                       string   `json:"Name"`
+	QuestionID                 int      `json:"QuestionID"`
+	LogicalOperator            string   `json:"LogicalOperator"`
+	NumberOfRequiredConditions int      `json:"NumberOfRequiredConditions"`
+	IsActive                   bool     `json:"IsActive"`
+	Order                      int      `json:"Order"`
+	PreCodes                   []string `json:"PreCodes"`
+}
+
+// QuotaCondition matches respondents with one of PreCodes as the answer to
+// the question with QuestionID.
+type QuotaCondition struct {
+	QuestionID int      `json:"QuestionID"`
+	PreCodes   []string `json:"PreCodes"`
+}
+
+// Quota caps the respondents matching all of Conditions. ID is set by the
+// API.
+type Quota struct {
+	ID         int              `json:"SurveyQuotaID,omitempty"`
+	Name       string           `json:"Name"`
+	Quota      int              `json:"Quota"`
+	IsActive   bool             `json:"IsActive"`
+	Conditions []QuotaCondition `json:"Conditions"`
+}
+
+// quotaResult is the body of a quota created by the version 1 endpoint.
+type quotaResult struct {
+	Quota Quota `json:"Quota"`
+}
+
+// CreateSurvey creates a survey from req.
+func (c *Client) CreateSurvey(ctx context.Context, req SurveyRequest, idempotencyKey string) (Survey, error) {
+	var survey Survey
+	err := c.do(ctx, "POST", SURVEYS_PATH, idempotencyKey, req, &survey)
+	if err != nil {
+		return survey, fmt.Errorf("unable to create survey: %w", err)
+	}
+	return survey, nil
+}
+
+// AddQualification adds qualification to the survey with surveyID.
+func (c *Client) AddQualification(ctx context.Context, surveyID int, qualification Qualification, idempotencyKey string) error {
+	path := fmt.Sprintf("%s/%d", QUALIFICATIONS_PATH, surveyID)
+	err := c.do(ctx, "POST", path, idempotencyKey, qualification, nil)
+	if err != nil {
+		return fmt.Errorf("unable to add qualification %s: %w", qualification.Name, err)
+	}
+	return nil
+}
+
+// AddQuota adds quota to the survey with surveyID and returns it with its ID.
+func (c *Client) AddQuota(ctx context.Context, surveyID int, quota Quota, idempotencyKey string) (Quota, error) {
+	path := fmt.Sprintf("%s/%d", QUOTAS_PATH, surveyID)
+	var result quotaResult
+	err := c.do(ctx, "POST", path, idempotencyKey, quota, &result)
+	if err != nil {
+		return result.Quota, fmt.Errorf("unable to add quota %s: %w", quota.Name, err)
+	}
+	return result.Quota, nil
+}
+
+// ApplyExchangeTemplate applies the supplier exchange template with
+// templateID to the survey with surveyID.
+func (c *Client) ApplyExchangeTemplate(ctx context.Context, surveyID int, templateID int, idempotencyKey string) error {
+	path := fmt.Sprintf("%s/%d/%d", EXCHANGE_TEMPLATES_PATH, surveyID, templateID)
+	err := c.do(ctx, "POST", path, idempotencyKey, nil, nil)
+	if err != nil {
+		return fmt.Errorf("unable to apply exchange template %d: %w", templateID, err)
+	}
+	return nil
+}
+
+// SurveyUpdate changes the fields of a survey that are set.
+type SurveyUpdate struct {
+	Status       *string  `json:"status,omitempty"`
+	Quantity     *int     `json:"quantity,omitempty"`
+	SurveyCPIUSD *float32 `json:"survey_cpi_usd,omitempty"`
+}
+
+// UpdateSurvey applies update to the survey with surveyID.
+func (c *Client) UpdateSurvey(ctx context.Context, surveyID int, update SurveyUpdate, idempotencyKey string) error {
+	path := fmt.Sprintf("%s/%d", SURVEYS_PATH, surveyID)
+	err := c.do(ctx, "PATCH", path, idempotencyKey, update, nil)
+	if err != nil {
+		return fmt.Errorf("unable to update survey %d: %w", surveyID, err)
+	}
+	return nil
+}
+
+// SetStatus changes the status of the survey with surveyID.
+func (c *Client) SetStatus(ctx context.Context, surveyID int, status string, idempotencyKey string) error {
+	err := c.UpdateSurvey(ctx, surveyID, SurveyUpdate{Status: &status}, idempotencyKey)
+	if err != nil {
+		return fmt.Errorf("unable to set survey %d to %s: %w", surveyID, status, err)
+	}
+	return nil
+}
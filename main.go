@@ -10,19 +10,19 @@ import (
 	"html/template"
 	"io"
 	"log"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
-	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/schema"
+	"github.com/loganamcnichols/ai-debate/lucid"
 	"github.com/sashabaranov/go-openai"
 
 	"github.com/joho/godotenv"
@@ -31,6 +31,8 @@ import (
 
 const AI_DEBATE_PROJECT_ID = 27337152
 
+const DEFAULT_SITE_URL = "https://ai-debate.org"
+
 var TEMPLATE_PARAMS = url.Values{
 	"responseID":   []string{"[%RID%]"},
 	"panelistID":   []string{"[%PID%]"},
@@ -44,11 +46,10 @@ var TEMPLATE_PARAMS = url.Values{
 }
 
 var (
-	innovationFirstStmt     *sql.Stmt
+	responseConditionStmt   *sql.Stmt
 	surveyInsertStmt        *sql.Stmt
-	chatTimeQueryStmt       *sql.Stmt
+	surveyConfigQueryStmt   *sql.Stmt
 	responseQueryStmt       *sql.Stmt
-	responseUpdateStmt      *sql.Stmt
 	chatHistoryStmt         *sql.Stmt
 	insertChatStmt          *sql.Stmt
 	responseInsertStmt      *sql.Stmt
@@ -59,86 +60,124 @@ var (
 
 var (
 	TEMPLATE_LINK              *url.URL
-	SURVEY_ENDPOINT            *url.URL
-	PROJECT_ENDPOINT           *url.URL
-	QUALIFICATION_ENDPOINT     *url.URL
-	EXCHANGE_TEMPLATE_ENDPOINT *url.URL
-	COMPLETE_URL               *url.URL
 	SURVEYOR_CLIENT_ID         = 9676
 	BLOCKED_VENDOR_TEMPLATE_ID = 1839
 )
 
-const DEFAULT_CHAT_TIME = 15
-
-type Qualification struct {
-	Name       string
-	QuestionID int
-	PreCodes   []string
-}
+var lucidClient *lucid.Client
 
-type QuestionRow struct {
-	QuestionID    uuid.UUID `db:"id"`
-	ResponseID    uuid.UUID `db:"response_id"`
-	UserMsg       string    `db:"user_msg"`
-	SafetyMsg     string    `db:"safety_msg"`
-	InnovationMsg string    `db:"innovation_msg"`
-	CreateTime    time.Time `db:"create_time"`
-}
+const DEFAULT_CHAT_TIME = 15
 
-type SurveyResponse struct {
-	ID                    *uuid.UUID `db:"id" schema:"id"`
-	SurveyID              *uuid.UUID `db:"survey_id" schema:"survey_id"`
-	ResponseID            string     `db:"response_id" schema:"response_id"`
-	StartTime             *time.Time `db:"start_time" schema:"start_time"`
-	WhichLLM              string     `db:"which_llm" schema:"which_llm"`
-	AISpeed               string     `db:"ai_speed" schema:"ai_speed"`
-	PowerXBadActor        string     `db:"power_x_bad_actor" schema:"power-x-bad-actor"`
-	AIRegulationApproach  string     `db:"ai_regulation_approach" schema:"ai-regulation-approach"`
-	BanXNoRegulation      string     `db:"ban_x_no_regulation" schema:"ban-x-no-regulation"`
-	BanXMandates          string     `db:"ban_x_mandates" schema:"ban-x-mandates"`
-	MandatesXNoRegulation string     `db:"mandates_x_no_regulation" schema:"mandates-x-no-regulation"`
-	MuskOpinion           string     `db:"musk_opinion" schema:"musk_opinion"`
-	PattersonOpinion      string     `db:"patterson_opinion" schema:"patterson_opinion"`
-	KensingtonOpinion     string     `db:"kensington_opinion" schema:"kensington_opinion"`
-	Potholes              string     `db:"potholes" schema:"potholes"`
+// INACTIVE_TIME is how long a participant can go without a message in the
+// chat before being exited for quality.
+const INACTIVE_TIME = 3 * time.Minute
+
+// SurveyConfig is the per survey configuration read when a chat starts.
+type SurveyConfig struct {
+	ChatTime     int
+	Provider     string
+	Parity       string
+	Generation   GenerationSettings
+	BotOverrides map[string]GenerationSettings
+	// PromptVersions pins prompt names to a version. Unpinned prompts use
+	// the version currently on disk.
+	PromptVersions map[string]string
+	Topics         []Topic
+	Personas       []Persona
+	// Conditions are the experimental arms of the default design.
+	Conditions []string
+	Design     Design
+	// Questionnaire defines the questions asked before and after the chat.
+	Questionnaire Questionnaire
+	// Seed, with the response ID, determines every random draw for the
+	// survey's responses.
+	Seed int64
 }
 
-func (sq *SurveyResponse) Scan(row *sql.Row) error {
-	return row.Scan(
-		&sq.ID,
-		&sq.SurveyID,
-		&sq.ResponseID,
-		&sq.StartTime,
-		&sq.WhichLLM,
-		&sq.AISpeed,
-		&sq.PowerXBadActor,
-		&sq.AIRegulationApproach,
-		&sq.BanXNoRegulation,
-		&sq.BanXMandates,
-		&sq.MandatesXNoRegulation,
-		&sq.MuskOpinion,
-		&sq.PattersonOpinion,
-		&sq.KensingtonOpinion,
-		&sq.Potholes,
-	)
+func defaultSurveyConfig() SurveyConfig {
+	return SurveyConfig{
+		ChatTime:      DEFAULT_CHAT_TIME,
+		Provider:      OPENAI_PROVIDER,
+		Parity:        DEFAULT_PARITY,
+		Topics:        DEFAULT_TOPICS,
+		Personas:      DEFAULT_PERSONAS,
+		Conditions:    DEFAULT_CONDITIONS,
+		Design:        defaultDesign(DEFAULT_CONDITIONS),
+		Questionnaire: defaultQuestionnaire,
+	}
 }
 
-func (sq *SurveyResponse) Update() error {
-	_, err := responseUpdateStmt.Exec(
-		sq.WhichLLM,
-		sq.AISpeed,
-		sq.PowerXBadActor,
-		sq.AIRegulationApproach,
-		sq.BanXNoRegulation,
-		sq.BanXMandates,
-		sq.MandatesXNoRegulation,
-		sq.MuskOpinion,
-		sq.PattersonOpinion,
-		sq.KensingtonOpinion,
-		sq.Potholes,
-		sq.ID,
+func (sc *SurveyConfig) Scan(row *sql.Row) error {
+	var model, reasoningEffort sql.NullString
+	var temperature sql.NullFloat64
+	var maxTokens sql.NullInt64
+	var stream sql.NullBool
+	var botSettings, promptVersions, topics, personas, conditions, design, questionnaire []byte
+	var seed sql.NullInt64
+	err := row.Scan(
+		&sc.ChatTime,
+		&sc.Provider,
+		&sc.Parity,
+		&model,
+		&temperature,
+		&reasoningEffort,
+		&maxTokens,
+		&stream,
+		&botSettings,
+		&promptVersions,
+		&topics,
+		&personas,
+		&conditions,
+		&design,
+		&seed,
+		&questionnaire,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	sc.Seed = seed.Int64
+	scanGeneration(&sc.Generation, model, temperature, reasoningEffort, maxTokens, stream)
+	if len(botSettings) > 0 {
+		if err := json.Unmarshal(botSettings, &sc.BotOverrides); err != nil {
+			return err
+		}
+	}
+	if len(promptVersions) > 0 {
+		if err := json.Unmarshal(promptVersions, &sc.PromptVersions); err != nil {
+			return err
+		}
+	}
+	sc.Topics = DEFAULT_TOPICS
+	if len(topics) > 0 {
+		if err := json.Unmarshal(topics, &sc.Topics); err != nil {
+			return err
+		}
+	}
+	sc.Personas = DEFAULT_PERSONAS
+	if len(personas) > 0 {
+		if err := json.Unmarshal(personas, &sc.Personas); err != nil {
+			return err
+		}
+	}
+	sc.Conditions = DEFAULT_CONDITIONS
+	if len(conditions) > 0 {
+		if err := json.Unmarshal(conditions, &sc.Conditions); err != nil {
+			return err
+		}
+	}
+	sc.Questionnaire = defaultQuestionnaire
+	if len(questionnaire) > 0 {
+		sc.Questionnaire = Questionnaire{}
+		if err := json.Unmarshal(questionnaire, &sc.Questionnaire); err != nil {
+			return err
+		}
+	}
+	sc.Design = defaultDesign(sc.Conditions)
+	if len(design) > 0 {
+		sc.Design = Design{}
+		return json.Unmarshal(design, &sc.Design)
+	}
+	return nil
 }
 
 func buildExpandedURL(baseURL string, params url.Values) string {
@@ -158,36 +197,11 @@ type ChatMessage struct {
 	Content    string
 }
 
-type QuantityType string
-
-const (
-	PRESCREENS QuantityType = "prescreens"
-	COMPLETES  QuantityType = "completes"
-)
-
-type SurveyRequest struct {
-	BusinessUnitID int          `json:"business_unit_id"`
-	Locale         string       `json:"locale"`
-	Name           string       `json:"name"`
-	ProjectID      int          `json:"project_id"`
-	CollectsPII    bool         `json:"collects_pii"`
-	LiveURL        string       `json:"live_url"`
-	Quantity       int          `json:"quantity"`
-	QuantityType   QuantityType `json:"quantity_calc_type"`
-	Status         string       `json:"status"`
-	TestURL        string       `json:"test_url"`
-	SurveyCPIUSD   float32      `json:"survey_cpi_usd"`
-	StudyType      string       `json:"study_type"`
-	Industry       string       `json:"industry"`
-	CompletionRate float32      `json:"expected_incidence_rate"`
-	SurveyMinutes  int          `json:"expected_completion_loi"`
-}
-
-func newSurveyRequest(name string, projectID int, prescreens int, chatTime int, surveyID uuid.UUID) *SurveyRequest {
+func newSurveyRequest(name string, projectID int, prescreens int, chatTime int, surveyID uuid.UUID) lucid.SurveyRequest {
 
 	base := *TEMPLATE_LINK.JoinPath(surveyID.String())
 	full := buildExpandedURL(base.String(), TEMPLATE_PARAMS)
-	return &SurveyRequest{
+	return lucid.SurveyRequest{
 		BusinessUnitID: 3175,
 		Locale:         "eng_us",
 		Name:           name,
@@ -195,10 +209,10 @@ func newSurveyRequest(name string, projectID int, prescreens int, chatTime int,
 		CollectsPII:    false,
 		LiveURL:        full,
 		Quantity:       prescreens,
-		QuantityType:   PRESCREENS,
-		Status:         "awarded",
+		QuantityType:   lucid.PRESCREENS,
+		Status:         lucid.STATUS_AWARDED,
 		TestURL:        full,
-		SurveyCPIUSD:   0.5,
+		SurveyCPIUSD:   DEFAULT_CPI_USD,
 		StudyType:      "adhoc",
 		Industry:       "other",
 		CompletionRate: 1.0,
@@ -206,88 +220,6 @@ func newSurveyRequest(name string, projectID int, prescreens int, chatTime int,
 	}
 }
 
-// ConvertString converts a string to a UUID
-func ConvertString(value string) reflect.Value {
-	id, err := uuid.Parse(value)
-	if err != nil {
-		return reflect.Value{}
-	}
-	return reflect.ValueOf(id)
-}
-
-func range18Plus() []string {
-	var ages []string
-	for i := 18; i < 100; i++ {
-		ages = append(ages, fmt.Sprint(i))
-	}
-	return ages
-}
-
-func addQualifications(lucidID int) error {
-	client := http.Client{}
-	qualifations := []Qualification{
-		{
-			Name:       "AGE",
-			QuestionID: 42,
-			PreCodes:   range18Plus(),
-		},
-		{
-			Name:       "GENDER",
-			QuestionID: 43,
-			PreCodes:   []string{},
-		},
-		{
-			Name:       "HISPANIC",
-			QuestionID: 47,
-			PreCodes:   []string{},
-		},
-		{
-			Name:       "ETHNICITY",
-			QuestionID: 113,
-			PreCodes:   []string{},
-		},
-		{
-			Name:       "STANDARD_VOTE",
-			QuestionID: 634,
-			PreCodes:   []string{},
-		},
-		{
-			Name:       "ZIP",
-			QuestionID: 45,
-			PreCodes:   []string{},
-		},
-	}
-	for _, qual := range qualifations {
-		data, err := json.Marshal(qual)
-		if err != nil {
-			return err
-		}
-		qualificationsEndpoint := *QUALIFICATION_ENDPOINT.JoinPath(fmt.Sprint(lucidID))
-		req, err := http.NewRequest("POST", qualificationsEndpoint.String(), bytes.NewBuffer(data))
-		if err != nil {
-			return fmt.Errorf("unable to create qualification request: %v", err)
-		}
-		addLucidHeaders(req)
-
-		_, err = client.Do(req)
-		if err != nil {
-			return fmt.Errorf("unable to add qualification: %v", err)
-		}
-	}
-	return nil
-}
-
-func (q *QuestionRow) Scan(rows *sql.Rows) error {
-	return rows.Scan(
-		&q.QuestionID,
-		&q.ResponseID,
-		&q.UserMsg,
-		&q.SafetyMsg,
-		&q.InnovationMsg,
-		&q.CreateTime,
-	)
-}
-
 type SortedResponses struct {
 	UserMsg         string
 	FirstResponse   string
@@ -385,18 +317,23 @@ func promptSuggest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	availablePrompts, ok := suggestionMap.Load(responseID)
-	if !ok {
-		availablePrompts = promptCopy()
-		suggestionMap.Store(responseID, availablePrompts)
+	availablePrompts, err := loadSuggestions(responseID)
+	if err != nil {
+		log.Printf("unable to load suggestions: %v\n", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 	if len(availablePrompts) == 0 {
 		w.Header().Set("HX-Reswap", "outerHTML")
 		fmt.Fprint(w, "<p>Try asking a question of your own.</p>")
 		return
 	}
-	choiceIdx := rand.Intn(len(availablePrompts))
-	choice := availablePrompts[choiceIdx]
+	// Suggestions are shown in their seeded order. The one shown moves to
+	// the back so the next poll shows the one after it.
+	choice := availablePrompts[0]
+	availablePrompts = append(slices.Clone(availablePrompts[1:]), choice)
+	suggestionMap.Store(responseID, availablePrompts)
+	choiceIdx := len(availablePrompts) - 1
 	err = tmpls.ExecuteTemplate(w, "question-suggestion.html", struct {
 		ChoiceIdx int
 		Choice    string
@@ -427,12 +364,11 @@ func suggestionSubmit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var availablePrompts []string
-	availablePrompts, ok := suggestionMap.Load(responseID)
-	if !ok {
-		log.Printf("not ok")
-		availablePrompts = promptCopy()
-		suggestionMap.Store(responseID, availablePrompts)
+	availablePrompts, err := loadSuggestions(responseID)
+	if err != nil {
+		log.Printf("unable to load suggestions: %v\n", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
 	if suggestionIdx >= len(availablePrompts) {
@@ -514,7 +450,7 @@ func formatSecondMessage(secondBot string) string {
 	return fmt.Sprintf("Now, %s will respond.", secondBot)
 }
 
-func streamOpenaiResponse(w http.ResponseWriter, stream *openai.ChatCompletionStream, msg ChatMessage) (text string, err error) {
+func streamOpenaiResponse(w http.ResponseWriter, stream ChatStream, msg ChatMessage, live bool, meta *GenerationMeta) (text string, err error) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
@@ -527,10 +463,11 @@ func streamOpenaiResponse(w http.ResponseWriter, stream *openai.ChatCompletionSt
 	defer throttle.Stop()
 
 	for range throttle.C {
-		var res openai.ChatCompletionStreamResponse
-		res, err = stream.Recv()
+		var delta string
+		delta, err = stream.Recv()
 		if errors.Is(err, io.EOF) {
 			err = nil
+			meta.finish(stream)
 			fmt.Fprintf(w, msgTmpl, msg.QuestionID.String(), msg.Role, convertToParagraphs(text))
 			flusher.Flush()
 			return
@@ -538,7 +475,13 @@ func streamOpenaiResponse(w http.ResponseWriter, stream *openai.ChatCompletionSt
 		if err != nil {
 			return
 		}
-		text += res.Choices[0].Delta.Content
+		if delta != "" {
+			meta.firstToken()
+		}
+		text += delta
+		if !live {
+			continue
+		}
 		fmt.Fprintf(w, msgTmpl, msg.QuestionID.String(), msg.Role, convertToParagraphs(text))
 		flusher.Flush()
 	}
@@ -570,24 +513,39 @@ func postTemplate(w http.ResponseWriter, eventName string, tmplName string, data
 	return nil
 }
 
-func streamIntroMsgs(w http.ResponseWriter, chatTime int) error {
-	err := postTemplate(w, "intro-msg", "intro-msg-1", struct{ ChatTime int }{ChatTime: chatTime})
+// IntroData is the data for the intro-msg templates.
+type IntroData struct {
+	ChatTime  int
+	TopicTime int
+	Condition string
+	BotCount  int
+}
+
+func streamIntroMsgs(w http.ResponseWriter, chatTime int, topicCount int, condition string, botCount int) error {
+	data := IntroData{
+		ChatTime:  chatTime,
+		TopicTime: chatTime / topicCount,
+		Condition: condition,
+		BotCount:  botCount,
+	}
+	err := postTemplate(w, "intro-msg", "intro-msg-1", data)
 	if err != nil {
 		return fmt.Errorf("unable to parse template 'intro-msg-1': %v", err)
 	}
 	time.Sleep(2 * time.Second)
-	err = postTemplate(w, "intro-msg", "intro-msg-2", nil)
+	err = postTemplate(w, "intro-msg", "intro-msg-2", data)
 	if err != nil {
 		return fmt.Errorf("unable to parse template 'intro-msg-2': %v", err)
 	}
 	time.Sleep(2 * time.Second)
-	err = postTemplate(w, "intro-msg", "intro-msg-3", nil)
-	if err != nil {
-		return fmt.Errorf("unable to parse template 'intro-msg-3': %v", err)
+	if condition == CONDITION_DEBATE {
+		err = postTemplate(w, "intro-msg", "intro-msg-3", data)
+		if err != nil {
+			return fmt.Errorf("unable to parse template 'intro-msg-3': %v", err)
+		}
+		time.Sleep(2 * time.Second)
 	}
-	time.Sleep(2 * time.Second)
-	topicTime := chatTime / 3
-	err = postTemplate(w, "intro-msg", "intro-msg-4", struct{ TopicTime int }{TopicTime: topicTime})
+	err = postTemplate(w, "intro-msg", "intro-msg-4", data)
 	if err != nil {
 		return fmt.Errorf("unable to parse template 'intro-msg-4': %v", err)
 	}
@@ -595,75 +553,59 @@ func streamIntroMsgs(w http.ResponseWriter, chatTime int) error {
 	return nil
 }
 
-func formatMessages(responseID uuid.UUID) ([]openai.ChatCompletionMessage, bool, error) {
+// formatMessages rebuilds the conversation sent to the bots from the stored
+// chat and returns it with the number of questions asked so far. The first
+// message is left empty for the system prompt.
+func formatMessages(responseID uuid.UUID, personas []Persona) ([]openai.ChatCompletionMessage, int, error) {
 	messages := []openai.ChatCompletionMessage{{}}
-	var innovateFirst bool
-	err := innovationFirstStmt.QueryRow(responseID).Scan(&innovateFirst)
-	if err != nil {
-		return messages, false, fmt.Errorf("failed to execute innovationFirstStmt: %v", err)
+	labels := map[string]string{}
+	for _, persona := range personas {
+		labels[persona.Name] = persona.DisplayLabel()
 	}
 
 	rows, err := chatHistoryStmt.Query(responseID)
 	if err != nil {
-		return messages, false, fmt.Errorf("failed to execute chatHistoryStmt: %v", err)
+		return messages, 0, fmt.Errorf("failed to execute chatHistoryStmt: %v", err)
 	}
 	defer rows.Close()
-	var nextRow QuestionRow
+
+	var questionCount int
+	var lastQuestionID uuid.UUID
 	for rows.Next() {
-		if err := nextRow.Scan(rows); err != nil {
-			return messages, false, err
+		var questionID uuid.UUID
+		var userMsg, persona, content string
+		if err := rows.Scan(&questionID, &userMsg, &persona, &content); err != nil {
+			return messages, 0, err
 		}
-		if innovateFirst {
-			messages = append(messages, []openai.ChatCompletionMessage{
-				{
-					Role:    "user",
-					Content: formatFirstMessage(nextRow.UserMsg, "Innovate Bot"),
-				},
-				{
-					Role:    "assistant",
-					Name:    "InnovateBot",
-					Content: formatFirstMessage(nextRow.InnovationMsg, "Innovate Bot"),
-				},
-				{
-					Role:    "user",
-					Content: formatSecondMessage("Safety Bot"),
-				},
-				{
-					Role:    "assistant",
-					Name:    "SafetyBot",
-					Content: nextRow.SafetyMsg,
-				}}...)
-		} else {
-			messages = append(messages, []openai.ChatCompletionMessage{
-				{
-					Role:    "user",
-					Content: formatFirstMessage(nextRow.UserMsg, "Safety Bot"),
-				},
-				{
-					Role:    "assistant",
-					Name:    "SafetyBot",
-					Content: nextRow.SafetyMsg,
-				},
-				{
-					Role:    "user",
-					Content: formatSecondMessage("Innovate Bot"),
-				},
-				{
-					Role:    "assistant",
-					Name:    "InnovateBot",
-					Content: nextRow.InnovationMsg,
-				}}...)
+		label, ok := labels[persona]
+		if !ok {
+			label = persona
 		}
-		innovateFirst = !innovateFirst
-	}
-	if rows.Err() != nil {
-		return messages, false, err
-	}
-
-	return messages, innovateFirst, nil
+		prompt := formatSecondMessage(label)
+		if questionID != lastQuestionID {
+			lastQuestionID = questionID
+			questionCount++
+			prompt = formatFirstMessage(userMsg, label)
+		}
+		messages = append(messages, []openai.ChatCompletionMessage{
+			{
+				Role:    "user",
+				Content: prompt,
+			},
+			{
+				Role:    "assistant",
+				Name:    persona,
+				Content: content,
+			}}...)
+	}
+	if err := rows.Err(); err != nil {
+		return messages, 0, err
+	}
+
+	return messages, questionCount, nil
 }
 
-func processStreamError(w http.ResponseWriter, responseID uuid.UUID, questionID uuid.UUID, userInput string) {
+func processStreamError(w http.ResponseWriter, responseID uuid.UUID, questionID uuid.UUID, userInput string, personas []Persona) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
@@ -671,10 +613,10 @@ func processStreamError(w http.ResponseWriter, responseID uuid.UUID, questionID
 	}
 	fmt.Fprintf(w, "event: %s-%s-delete\ndata: <p></p>\n\n", questionID.String(), "user")
 	flusher.Flush()
-	fmt.Fprintf(w, "event: %s-%s-delete\ndata: <p></p>\n\n", questionID.String(), "InnovateBot")
-	flusher.Flush()
-	fmt.Fprintf(w, "event: %s-%s-delete\ndata: <p></p>\n\n", questionID.String(), "SafetyBot")
-	flusher.Flush()
+	for _, persona := range personas {
+		fmt.Fprintf(w, "event: %s-%s-delete\ndata: <p></p>\n\n", questionID.String(), persona.Name)
+		flusher.Flush()
+	}
 	postTemplate(w, "active-form", "form-error.html", struct {
 		ResponseID string
 		UserInput  string
@@ -710,7 +652,7 @@ func streamResponse(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var chatTime = DEFAULT_CHAT_TIME
+	surveyConfig := defaultSurveyConfig()
 	if surveyIDParam != "" {
 		surveyID, err := uuid.Parse(surveyIDParam)
 		if err != nil {
@@ -718,44 +660,116 @@ func streamResponse(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "invalid survey-id parameter", http.StatusBadRequest)
 			return
 		}
-		err = chatTimeQueryStmt.QueryRow(surveyID).Scan(&chatTime)
+		err = surveyConfig.Scan(surveyConfigQueryStmt.QueryRow(surveyID))
 		if err != nil {
-			log.Printf("failed to get chat time: %v", err)
+			log.Printf("failed to get survey config: %v", err)
 			http.Error(w, "internal server serror", http.StatusInternalServerError)
 			return
 		}
 	}
+	chatTime := surveyConfig.ChatTime
+	if providerOverride != "" {
+		surveyConfig.Provider = providerOverride
+	}
 
 	var chatHistoryLen int
-	err = chatCountStmt.QueryRow(responseID).Scan(&chatHistoryLen)
+	var lastChat *time.Time
+	err = chatCountStmt.QueryRow(responseID).Scan(&chatHistoryLen, &lastChat)
 	if err != nil {
 		log.Printf("failed to execute query for count")
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	participant, chatStart, err := queryParticipant(responseID)
+	if err != nil {
+		log.Printf("failed to query participant: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if chatStart == nil {
+		http.Error(w, "the pre-survey is not complete", http.StatusForbidden)
+		return
+	}
+	chatEnd := chatStart.Add(time.Duration(chatTime) * time.Minute)
+	topics := surveyConfig.Topics
+
+	var innovateFirst bool
+	var condition string
+	var assignmentData []byte
+	var seed int64
+	err = responseConditionStmt.QueryRow(responseID).Scan(&innovateFirst, &condition, &assignmentData, &seed)
+	if err != nil {
+		log.Printf("failed to execute responseConditionStmt: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	assignment, err := scanAssignment(assignmentData)
+	if err != nil {
+		log.Printf("%v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	surveyConfig = surveyConfig.WithAssignment(assignment)
+	offset := rotationOffset(innovateFirst)
+	personas := surveyConfig.ConditionPersonas(condition, innovateFirst)
+
+	schedule := topicSchedule(topics, chatTime)
+
+	log.Println("topic schedule", schedule)
+
+	// The topics follow the schedule from the start of the chat, so a
+	// participant who reconnects or joins late is on the topic under way.
+	current := scheduledSection(schedule, time.Since(*chatStart))
+
+	// section is written by the timer goroutine and read by the chat loop.
+	var section atomic.Int32
+	section.Store(int32(current))
+
 	chatMap.Delete(responseID)
 	userChannel := make(chan string, 1)
+	// A reconnecting participant keeps the suggestions not used yet.
+	if _, ok := suggestionMap.Load(responseID); (chatHistoryLen == 0 || !ok) && len(topics[current-1].Suggestions) > 0 {
+		suggestionMap.Store(responseID, topicSuggestions(topics[current-1], current, seed, responseID))
+	}
 	if chatHistoryLen == 0 {
-		userChannel <- "Regulation vs. Deregulation in AI Development"
-		if err = streamIntroMsgs(w, chatTime); err != nil {
+		userChannel <- topics[current-1].OpeningMessage()
+		if err = streamIntroMsgs(w, chatTime, len(topics), condition, len(personas)); err != nil {
 			log.Printf("failed to load intro msgs: %v\n", err)
 			http.Error(w, "internal server error", http.StatusInternalServerError)
 			return
 		}
-		postTemplate(w, "update-list", "topic-list", 1)
 	}
+	postTemplate(w, "update-list", "topic-list", TopicListItem{Index: current, Title: topics[current-1].Title})
 	chatMap.Store(responseID, userChannel)
 
-	sectionDuration := time.Duration(60 * chatTime / 3) * time.Second
-
-	log.Println("section duration", sectionDuration)
-
-	inactiveTimer := time.NewTimer(3 * time.Minute)
+	// Inactivity is counted from the last message, or the start of the chat,
+	// so reconnecting does not give the participant more time.
+	lastActive := *chatStart
+	if lastChat != nil && lastChat.After(lastActive) {
+		lastActive = *lastChat
+	}
+	inactiveTimer := time.NewTimer(time.Until(lastActive.Add(INACTIVE_TIME)))
+	if condition == CONDITION_STATIC {
+		// There is nothing to engage with in the static condition.
+		inactiveTimer.Stop()
+	}
 	keepAliveTicker := time.NewTicker(20 * time.Second)
 
-	secondSectionStart := time.NewTimer(sectionDuration)
-	thirdSectionStart := time.NewTimer(2 * sectionDuration)
+	// sectionStart fires when the next topic begins. It stays nil, and so
+	// never fires, once the last topic has started.
+	var sectionTimer *time.Timer
+	var sectionStart <-chan time.Time
+	if current < len(topics) {
+		sectionTimer = time.NewTimer(time.Until(chatStart.Add(schedule[current])))
+		sectionStart = sectionTimer.C
+	} else if current > 1 {
+		// The last topic started while the participant was away.
+		_, err := markIncomplete.Exec(responseID)
+		if err != nil {
+			log.Printf("failed to execute markIncomplete stmt %v\n", err)
+		}
+	}
 
 	go func() {
 		for {
@@ -767,14 +781,28 @@ func streamResponse(w http.ResponseWriter, r *http.Request) {
 				fmt.Fprintf(w, "event: keep-alive\ndata: \n\n")
 				flusher.Flush()
 			case <-inactiveTimer.C:
-				fmt.Fprintf(w, "event: inactive\ndata: \n\n")
-				flusher.Flush()
-			case <-secondSectionStart.C:
-				postTemplate(w, "update-list", "topic-list", 2)
-				userChannel <- "Economic Transformation: Job Creation vs. Displacement"
-			case <-thirdSectionStart.C:
-				postTemplate(w, "update-list", "topic-list", 3)
-				userChannel <- "Developing Super-Human General-Purpose AI"
+				// The exit is loaded by the page, which follows the
+				// redirect.
+				if _, err := recordExit(responseID, EXIT_QUALITY); err != nil {
+					log.Printf("unable to record inactive exit: %v\n", err)
+					continue
+				}
+				if err := postTemplate(w, "inactive", "exit-redirect.html", responseID); err != nil {
+					log.Printf("failed to post exit-redirect template: %v\n", err)
+				}
+			case <-sectionStart:
+				next := int(section.Add(1))
+				topic := topics[next-1]
+				if len(topic.Suggestions) > 0 {
+					suggestionMap.Store(responseID, topicSuggestions(topic, next, seed, responseID))
+				}
+				postTemplate(w, "update-list", "topic-list", TopicListItem{Index: next, Title: topic.Title})
+				userChannel <- topic.OpeningMessage()
+				if next < len(topics) {
+					sectionTimer.Reset(time.Until(chatStart.Add(schedule[next])))
+					continue
+				}
+				sectionStart = nil
 				_, err := markIncomplete.Exec(responseID)
 				if err != nil {
 					log.Printf("failed to execute markIncomplete stmt %v\n", err)
@@ -784,48 +812,44 @@ func streamResponse(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	for userMsg := range userChannel {
-		inactiveTimer.Reset(3 * time.Minute)
-		messages, innovateNext, err := formatMessages(responseID)
-		if err != nil {
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-		}
-
-		var firstPromptFile string
-		var secondPromptFile string
-
-		var firstBotName string
-		var secondBotName string
-
-		if innovateNext {
-			firstPromptFile = "PRO_INNOVATION_PROMPT.txt"
-			secondPromptFile = "PRO_SAFETY_PROMPT.txt"
-
-			firstBotName = "InnovateBot"
-			secondBotName = "SafetyBot"
-
-			fmt.Fprint(w, "event: innovation-first\ndata: true\n\n")
-
-			flusher.Flush()
-
-		} else {
-			firstPromptFile = "PRO_SAFETY_PROMPT.txt"
-			secondPromptFile = "PRO_INNOVATION_PROMPT.txt"
-
-			firstBotName = "SafetyBot"
-			secondBotName = "InnovateBot"
-
-			fmt.Fprintf(w, "event: innovation-first\ndata: false\n\n")
-			flusher.Flush()
+		if condition == CONDITION_STATIC {
+			// The chat form is never activated, so the only messages are
+			// section openings.
+			questionID := uuid.New()
+			err = postTemplate(w, "chat-msg", "chat-msg", ChatMessage{
+				QuestionID: questionID,
+				Role:       "user",
+				Content:    userMsg,
+			})
+			if err != nil {
+				log.Printf("failed to post chat-message template: %v", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+			err = streamReading(w, questionID, topics[section.Load()-1])
+			if err != nil {
+				log.Printf("failed to stream reading: %v", err)
+				return
+			}
+			err = insertChat(questionID, responseID, userMsg, nil)
+			if err != nil {
+				log.Printf("failed to insert chat: %v", err)
+				return
+			}
+			continue
 		}
 
-		firstSystemPrompt, err := os.ReadFile(firstPromptFile)
-		if err != nil {
-			log.Printf("unable to read innovation prompt: %v", err)
-		}
-		secondSystemPrompt, err := os.ReadFile(secondPromptFile)
+		inactiveTimer.Reset(INACTIVE_TIME)
+		messages, questionCount, err := formatMessages(responseID, personas)
 		if err != nil {
-			log.Printf("unable to read safety prompt: %v", err)
+			log.Printf("failed to format messages: %v\n", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
 		}
+		speakers := speakingOrder(personas, offset+questionCount)
+
+		fmt.Fprintf(w, "event: first-speaker\ndata: %s\n\n", speakers[0].Name)
+		flusher.Flush()
 
 		questionID := uuid.New()
 
@@ -834,104 +858,64 @@ func streamResponse(w http.ResponseWriter, r *http.Request) {
 			Role:       "user",
 			Content:    userMsg,
 		}
-
-		firstRespMessage := ChatMessage{
-			QuestionID: questionID,
-			Role:       firstBotName,
-		}
-
-		secondRespMessage := ChatMessage{
-			QuestionID: questionID,
-			Role:       secondBotName,
-		}
-
 		err = postTemplate(w, "chat-msg", "chat-msg", userChatMessage)
 		if err != nil {
 			log.Printf("failed to post chat-message template: %v", err)
 			http.Error(w, "internal server error", http.StatusInternalServerError)
 			return
 		}
-
-		err = postTemplate(w, "chat-msg", "chat-msg", firstRespMessage)
-		if err != nil {
-			log.Printf("failed to post chat-message template: %v", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			return
-		}
-
-		err = postTemplate(w, "chat-msg", "chat-msg", secondRespMessage)
-		if err != nil {
-			log.Printf("failed to post chat-message template: %v", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			return
-		}
-
-		messages = append(messages, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: formatFirstMessage(userMsg, firstBotName),
-		})
-
-		messages[0] = openai.ChatCompletionMessage{
-			Role:    "system",
-			Content: string(firstSystemPrompt),
-		}
-
-		req := openai.ChatCompletionRequest{
-			Model:    openai.O3Mini,
-			Messages: messages,
-			Stream:   true,
-			ReasoningEffort: "low",
-		}
-
-		stream1, err := client.CreateChatCompletionStream(context.Background(), req)
-		if err != nil {
-			return
+		for _, persona := range speakers {
+			err = postTemplate(w, "chat-msg", "chat-msg", ChatMessage{
+				QuestionID: questionID,
+				Role:       persona.Name,
+			})
+			if err != nil {
+				log.Printf("failed to post chat-message template: %v", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
 		}
-		defer stream1.Close()
 
-		firstAnswer, err := streamOpenaiResponse(w, stream1, firstRespMessage)
-		if err != nil {
-			processStreamError(w, responseID, questionID, userMsg)
-			continue
+		currentSection := int(section.Load())
+		promptContext := PromptContext{
+			Speakers:         speakers,
+			topic:            topics[currentSection-1],
+			Section:          currentSection,
+			SectionCount:     len(topics),
+			Turn:             questionCount + 1,
+			MinutesRemaining: max(int(time.Until(chatEnd).Minutes()), 0),
+			Participant:      participant,
 		}
 
-		messages = append(messages, openai.ChatCompletionMessage{
-			Role:    "assistant",
-			Name:    firstBotName,
-			Content: firstAnswer,
-		})
-
-		messages = append(messages, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: formatSecondMessage(secondBotName),
-		})
+		replies := make([]BotReply, 0, len(speakers))
+		for position, persona := range speakers {
+			content := formatSecondMessage(persona.DisplayLabel())
+			if position == 0 {
+				content = formatFirstMessage(userMsg, persona.DisplayLabel())
+			}
+			messages = append(messages, openai.ChatCompletionMessage{
+				Role:    "user",
+				Content: content,
+			})
 
-		messages[0] = openai.ChatCompletionMessage{
-			Role:    "system",
-			Content: string(secondSystemPrompt),
-		}
+			reply, err := generateReply(w, surveyConfig, persona, position, messages, promptContext, questionID)
+			if err != nil {
+				log.Printf("%v\n", err)
+				break
+			}
+			replies = append(replies, reply)
 
-		req = openai.ChatCompletionRequest{
-			Model:    openai.GPT4oMini20240718,
-			Messages: messages,
-			Stream:   true,
+			messages = append(messages, openai.ChatCompletionMessage{
+				Role:    "assistant",
+				Name:    persona.Name,
+				Content: reply.Content,
+			})
 		}
-
-		stream2, err := client.CreateChatCompletionStream(context.Background(), req)
-		if err != nil {
-			log.Printf("ChatCompletionStream error: %v\n", err)
-			processStreamError(w, responseID, questionID, userMsg)
+		if len(replies) < len(speakers) {
+			processStreamError(w, responseID, questionID, userMsg, speakers)
 			continue
 		}
 
-		defer stream2.Close()
-
-		secondAnswer, err := streamOpenaiResponse(w, stream2, secondRespMessage)
-		if err != nil {
-			log.Printf("error streaming openai response: %v\n", err)
-			processStreamError(w, responseID, questionID, userMsg)
-		}
-
 		err = postTemplate(w, "active-form", "active-form", responseID.String())
 		if err != nil {
 			log.Printf("unable to execute template 'active-form': %v\n", err)
@@ -939,197 +923,78 @@ func streamResponse(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if innovateNext {
-			_, err := insertChatStmt.Exec(questionID, responseID, userMsg, secondAnswer, firstAnswer)
-			if err != nil {
-				log.Printf("error executing insertChatStmt: %v", err)
-				http.Error(w, "internal server error", http.StatusInternalServerError)
-				return
-			}
-		} else {
-			_, err := insertChatStmt.Exec(questionID, responseID, userMsg, firstAnswer, secondAnswer)
-			if err != nil {
-				log.Printf("error executing updateChatStmt: %v", err)
-				return
-			}
+		err = insertChat(questionID, responseID, userMsg, replies)
+		if err != nil {
+			log.Printf("failed to insert chat: %v", err)
+			return
 		}
 	}
 }
 
-func promptCopy() []string {
-	dst := make([]string, len(prompts))
-	copy(dst, prompts)
-	return dst
+func completeSurvey(w http.ResponseWriter, r *http.Request, survey SurveyResponse) {
+	exitSurvey(w, r, survey, EXIT_COMPLETE)
 }
 
-func completeSurvey(w http.ResponseWriter, survey SurveyResponse, responseID string) {
-	if survey.SurveyID == nil {
-		err := tmpls.ExecuteTemplate(w, "non-lucid-complete.html", nil)
-		if err != nil {
-			log.Printf("unable to execute non-lucid complete: %v\n", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-		}
-	} else {
-		completeURL := *COMPLETE_URL
-		params := completeURL.Query()
-		params.Add("RID", responseID)
-		completeURL.RawQuery = params.Encode()
-		w.Header().Set("HX-Redirect", completeURL.String())
-	}
+func handleSurvey(w http.ResponseWriter, r *http.Request) {
+	serveWave(w, r, WAVE_POST, completeSurvey)
 }
 
-func handleSurvey(w http.ResponseWriter, r *http.Request) {
-	var pageCount = 4
-	var survey SurveyResponse
-	decoder := schema.NewDecoder()
-	decoder.IgnoreUnknownKeys(true)
-	decoder.RegisterConverter(uuid.UUID{}, ConvertString)
-	ID, err := uuid.Parse(r.URL.Query().Get("response-id"))
-	if err != nil {
-		log.Printf("unable to parse reponse id %s: %v\n", r.URL.Query().Get("response-id"), err)
-		http.Error(w, "invalid response-id", http.StatusBadRequest)
-		return
-	}
-	err = r.ParseForm()
-	if err != nil {
-		log.Printf("error parsing form: %v\n", err)
+// launchSurvey creates the Lucid survey for surveyID with its targeting and
+// sets it live, filling in the Lucid IDs of quotas. If a step fails the
+// half-created survey is rolled back. Every request has an idempotency key
+// derived from surveyID, so retries do not repeat steps.
+func launchSurvey(ctx context.Context, name string, prescreens int, chatTime int, surveyID uuid.UUID, targeting Targeting, quotas []SurveyQuota) (int, error) {
+	key := func(step string) string {
+		return surveyID.String() + "/" + step
 	}
-	navigate := r.FormValue("navigate")
-	page, err := strconv.Atoi(r.FormValue("page"))
+	request := newSurveyRequest(name, AI_DEBATE_PROJECT_ID, prescreens, chatTime, surveyID)
+	survey, err := lucidClient.CreateSurvey(ctx, request, key("create"))
 	if err != nil {
-		log.Printf("unable to convert page %s: %v", r.FormValue("page"), err)
-		http.Error(w, "expected page parameter as an int", http.StatusBadRequest)
-		return
-	}
-	err = survey.Scan(responseQueryStmt.QueryRow(ID))
-	if err != nil {
-		log.Printf("error scanning survey questions: %v\n", err)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
+		return 0, err
 	}
-	if r.Method == "GET" {
-		tmplName := fmt.Sprintf("survey-page-%d", page)
-		err = tmpls.ExecuteTemplate(w, tmplName, survey)
-		if err != nil {
-			log.Printf("error execution template %s: %v", tmplName, err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			return
-		}
-	} else if r.Method == "POST" {
-		var missing bool
-		for _, vals := range r.PostForm {
-			if vals[len(vals)-1] == "missing" {
-				missing = true
-			}
-		}
-		if navigate == "next" && !missing {
-			page += 1
-		} else if navigate == "previous" {
-			page -= 1
-		}
-
-		err = decoder.Decode(&survey, r.PostForm)
-		if err != nil {
-			log.Printf("unable to decode form: %v\n", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			return
-		}
 
-		err = survey.Update()
+	for _, qualification := range targeting.qualifications() {
+		err = lucidClient.AddQualification(ctx, survey.ID, qualification, key("qualification/"+qualification.Name))
 		if err != nil {
-			log.Printf("failed to update survey: %v\n", err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			return
-		}
-
-		if page > pageCount {
-			completeSurvey(w, survey, survey.ResponseID)
-			return
+			return 0, rollbackSurvey(survey.ID, false, err)
 		}
-		tmplName := fmt.Sprintf("survey-page-%d", page)
-		err = tmpls.ExecuteTemplate(w, tmplName, survey)
+	}
+	for i, quota := range quotas {
+		created, err := lucidClient.AddQuota(ctx, survey.ID, quota.lucidQuota(), key("quota/"+quota.Question+"/"+quota.Cell))
 		if err != nil {
-			log.Printf("error execution template %s: %v", tmplName, err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			return
+			return 0, rollbackSurvey(survey.ID, false, err)
 		}
+		quotas[i].LucidQuotaID = &created.ID
 	}
-}
-
-
-func addLucidHeaders(req *http.Request) {
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", os.Getenv("LUCIDHQ_API_KEY"))
-}
-
-func createSurvey(name string, projectID int, prescreens int, chatTime int, surveyID uuid.UUID) (*int, error) {
-	requestParams := newSurveyRequest(name, projectID, prescreens, chatTime, surveyID)
-	data, err := json.Marshal(requestParams)
+	err = lucidClient.ApplyExchangeTemplate(ctx, survey.ID, BLOCKED_VENDOR_TEMPLATE_ID, key("exchange-template"))
 	if err != nil {
-		return nil, fmt.Errorf("unable to marshal SurveyRequest: %v", err)
+		return 0, rollbackSurvey(survey.ID, false, err)
 	}
-	req, err := http.NewRequest("POST", SURVEY_ENDPOINT.String(), bytes.NewBuffer(data))
+	err = lucidClient.SetStatus(ctx, survey.ID, lucid.STATUS_LIVE, key("live"))
 	if err != nil {
-		return nil, fmt.Errorf("unable to create new survey request: %v", err)
+		return 0, rollbackSurvey(survey.ID, true, err)
 	}
+	return survey.ID, nil
+}
 
-	addLucidHeaders(req)
-
-	client := http.Client{}
-	res, err := client.Do(req)
+// rollbackSurvey takes down the Lucid survey with lucidID after cause
+// stopped its launch. A survey that may have gone live is paused so its
+// respondents keep their sessions, and any other survey is archived. It
+// returns cause along with any error of the rollback itself.
+func rollbackSurvey(lucidID int, live bool, cause error) error {
+	status := lucid.STATUS_ARCHIVED
+	if live {
+		status = lucid.STATUS_PAUSED
+	}
+	// The request that failed may have been cancelled, so the rollback
+	// gets its own deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := lucidClient.SetStatus(ctx, lucidID, status, fmt.Sprintf("rollback/%d/%s", lucidID, status))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new survey: %v", err)
+		return fmt.Errorf("%v; rolling back survey %d also failed: %v", cause, lucidID, err)
 	}
-	var respTmpl struct {
-		ID  int       `json:"id"`
-		SID uuid.UUID `json:"sid"`
-	}
-
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read response boody: %v", err)
-	}
-
-	err = json.Unmarshal(body, &respTmpl)
-
-	return &respTmpl.ID, err
-}
-
-func applyBlockedVendorTemplate(surveyID int) error {
-	exchangeTemplateEndpoint := EXCHANGE_TEMPLATE_ENDPOINT.JoinPath(fmt.Sprint(surveyID), fmt.Sprint(BLOCKED_VENDOR_TEMPLATE_ID))
-	req, err := http.NewRequest("POST", exchangeTemplateEndpoint.String(), nil)
-	if err != nil {
-		return fmt.Errorf("unable to create request to %s: %v", EXCHANGE_TEMPLATE_ENDPOINT, err)
-	}
-	addLucidHeaders(req)
-
-	client := http.Client{}
-	_, err = client.Do(req)
-	if err != nil {
-		return fmt.Errorf("unable to complete block bendor template post: %v", err)
-	}
-	return nil
-}
-
-func setToLive(surveyID int) error {
-	surveyEndpoint := *SURVEY_ENDPOINT.JoinPath(fmt.Sprint(surveyID))
-	data, err := json.Marshal(struct {
-		Status string `json:"status"`
-	}{Status: "live"})
-	if err != nil {
-		return fmt.Errorf("unable to marshal json for set to live: %v", err)
-	}
-	req, err := http.NewRequest("PATCH", surveyEndpoint.String(), bytes.NewBuffer(data))
-	if err != nil {
-		return fmt.Errorf("unable to create request to set to live: %v", err)
-	}
-	addLucidHeaders(req)
-	client := http.Client{}
-	_, err = client.Do(req)
-	if err != nil {
-		return fmt.Errorf("unable to ")
-	}
-	return nil
+	return fmt.Errorf("%v; survey %d was set to %s", cause, lucidID, status)
 }
 
 func handleSurveyDeploy(w http.ResponseWriter, r *http.Request) {
@@ -1148,6 +1013,10 @@ func handleSurveyDeploy(w http.ResponseWriter, r *http.Request) {
 	chatTimeParam := r.FormValue("chatTime")
 	prescreenParam := r.FormValue("prescreens")
 	lucidLaunchParam := r.FormValue("lucidLaunch")
+	provider := r.FormValue("provider")
+	if provider == "" {
+		provider = OPENAI_PROVIDER
+	}
 
 	chatTime, chatTimeErr := strconv.Atoi(chatTimeParam)
 	prescreens, prescreensErr := strconv.Atoi(prescreenParam)
@@ -1163,46 +1032,191 @@ func handleSurveyDeploy(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "recieved invalid chatTime parameter", http.StatusBadRequest)
 		return
 	}
+	if !validProvider(provider) {
+		log.Printf("received invalid provider parameter %s", provider)
+		http.Error(w, "recieved invalid provider parameter", http.StatusBadRequest)
+		return
+	}
+	generation, err := parseGenerationSettings(r.FormValue)
+	if err != nil {
+		log.Printf("received invalid generation settings: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	botOverrides, err := parseBotOverrides(r.FormValue("botSettings"))
+	if err != nil {
+		log.Printf("received invalid botSettings: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parity := r.FormValue("parity")
+	if parity == "" {
+		parity = DEFAULT_PARITY
+	}
+	personaList, err := parsePersonas(r.FormValue("personas"))
+	if err != nil {
+		log.Printf("received invalid personas: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	botSettings, err := json.Marshal(botOverrides)
+	if err != nil {
+		log.Printf("unable to marshal botSettings: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	pinnedPrompts, err := parsePromptVersions(r.FormValue("promptVersions"))
+	if err != nil {
+		log.Printf("received invalid promptVersions: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	promptVersions, err := json.Marshal(pinnedPrompts)
+	if err != nil {
+		log.Printf("unable to marshal promptVersions: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	topicList, err := parseTopics(r.FormValue("topics"), chatTime)
+	if err != nil {
+		log.Printf("received invalid topics: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	topics, err := json.Marshal(topicList)
+	if err != nil {
+		log.Printf("unable to marshal topics: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	personas, err := json.Marshal(personaList)
+	if err != nil {
+		log.Printf("unable to marshal personas: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	conditionList, err := parseConditions(r.FormValue("conditions"), topicList)
+	if err != nil {
+		log.Printf("received invalid conditions: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conditions, err := json.Marshal(conditionList)
+	if err != nil {
+		log.Printf("unable to marshal conditions: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	questionnaireDef, err := parseQuestionnaire(r.FormValue("questionnaire"))
+	if err != nil {
+		log.Printf("received invalid questionnaire: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	questionnaire, err := json.Marshal(questionnaireDef)
+	if err != nil {
+		log.Printf("unable to marshal questionnaire: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	experimentDesign, err := parseDesign(r.FormValue("design"), conditionList, personaList, topicList, questionnaireDef)
+	if err != nil {
+		log.Printf("received invalid design: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = validateParity(parity, botOverrides, personaList, experimentDesign)
+	if err != nil {
+		log.Printf("received invalid parity parameter: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	design, err := json.Marshal(experimentDesign)
+	if err != nil {
+		log.Printf("unable to marshal design: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	seed, err := parseSeed(r.FormValue("seed"))
+	if err != nil {
+		log.Printf("received invalid seed: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	targetingDef, err := parseTargeting(r.FormValue("targeting"))
+	if err != nil {
+		log.Printf("received invalid targeting: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	targeting, err := json.Marshal(targetingDef)
+	if err != nil {
+		log.Printf("unable to marshal targeting: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	quotas := targetingDef.surveyQuotas(prescreens)
 
 	surveyName := fmt.Sprintf("AI Debate %s", time.Now().Format(time.DateTime))
 	var lucidID *int
 	if lucidLaunch {
-		lucidID, err = createSurvey(surveyName, AI_DEBATE_PROJECT_ID, prescreens, chatTime, surveyID)
-		if err != nil {
-			log.Println(err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			return
-		}
-
-		err = addQualifications(*lucidID)
-		if err != nil {
-			log.Println(err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			return
-		}
-
-		err = applyBlockedVendorTemplate(*lucidID)
+		id, err := launchSurvey(r.Context(), surveyName, prescreens, chatTime, surveyID, targetingDef, quotas)
 		if err != nil {
-			log.Println(err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			return
-		}
-
-		err = setToLive(*lucidID)
-		if err != nil {
-			log.Println(err)
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+			log.Printf("unable to launch lucid survey: %v\n", err)
+			http.Error(w, "unable to launch lucid survey", http.StatusBadGateway)
 			return
 		}
+		lucidID = &id
 	}
 
-	_, err = surveyInsertStmt.Exec(surveyID, lucidID, chatTime)
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("unable to execute surveyInsertStmt: %v\n", err)
+		log.Printf("unable to begin transaction: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Stmt(surveyInsertStmt).Exec(
+		surveyID,
+		lucidID,
+		chatTime,
+		provider,
+		parity,
+		generation.Model,
+		generation.Temperature,
+		generation.ReasoningEffort,
+		generation.MaxTokens,
+		generation.Stream,
+		string(botSettings),
+		string(promptVersions),
+		string(topics),
+		string(personas),
+		string(conditions),
+		string(design),
+		seed,
+		string(questionnaire),
+		string(targeting),
+	)
+	if err == nil {
+		err = insertQuotas(tx, surveyID, quotas)
+	}
+	if err == nil && lucidID != nil {
+		status, cpi := lucid.STATUS_LIVE, float32(DEFAULT_CPI_USD)
+		err = recordStatus(tx, surveyID, SurveyStatus{Action: ACTION_DEPLOY, Status: &status, Quantity: &prescreens, CPI: &cpi})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("unable to insert survey: %v\n", err)
+		// Respondents of a live survey without a row would be turned away.
+		if lucidID != nil {
+			log.Println(rollbackSurvey(*lucidID, true, err))
+		}
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, "https://ai-debate.org/%s", surveyID.String())
+	fmt.Fprint(w, TEMPLATE_LINK.JoinPath(surveyID.String()))
 }
 
 func handleLucidIndex(w http.ResponseWriter, r *http.Request) {
@@ -1249,107 +1263,160 @@ func handleLucidIndex(w http.ResponseWriter, r *http.Request) {
 		log.Println("one of the params is missing")
 	}
 
-	innovateFirst := (rand.Float32() > 0.5)
-
-	var chatTime int
-	err = chatTimeQueryStmt.QueryRow(&surveyID).Scan(&chatTime)
+	var surveyConfig SurveyConfig
+	err = surveyConfig.Scan(surveyConfigQueryStmt.QueryRow(&surveyID))
 	if err != nil {
-		log.Printf("error executing chatTime query: %v\n", err)
+		log.Printf("error executing surveyConfig query: %v\n", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	var id uuid.UUID
-	err = lucidResponseInsertStmt.QueryRow(responseID, surveyID, panelistID, supplierID, age, zip, gender, hispanic, ethnicity, standardVote, innovateFirst).Scan(&id)
+	participant := Participant{
+		Age:          age,
+		Gender:       gender,
+		Hispanic:     hispanic,
+		Ethnicity:    ethnicity,
+		StandardVote: standardVote,
+		Zip:          zip,
+	}
+	// Participants over quota are recorded without an assignment, so they
+	// do not take up a randomization slot.
+	over, err := overQuota(*surveyID, participant)
 	if err != nil {
-		log.Printf("error executing lucidResponseInsertStmt: %v\n", err)
+		log.Printf("unable to check quotas: %v\n", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
-
-	var data = struct {
-		QuestionRows []ChatMessage
-		ResponseID   string
-		SurveyID     string
-		ChatTime     int
-	}{
-		QuestionRows: []ChatMessage{},
-		ResponseID:   id.String(),
-		SurveyID:     surveyID.String(),
-		ChatTime:     chatTime,
+	if over {
+		id := uuid.New()
+		_, err = lucidResponseInsertStmt.Exec(id, responseID, surveyID, panelistID, supplierID, age, zip, gender, hispanic, ethnicity, standardVote,
+			false, nil, nil, nil, nil, surveyConfig.Seed, nil, nil)
+		if err != nil {
+			log.Printf("error executing lucidResponseInsertStmt: %v\n", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		exitSurvey(w, r, SurveyResponse{ID: &id, SurveyID: surveyID, ResponseID: responseID}, EXIT_OVER_QUOTA)
+		return
 	}
 
-	err = tmpls.ExecuteTemplate(w, "index.html", data)
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("error executing template: %v\n", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("unable to begin transaction: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
 	}
-}
+	defer tx.Rollback()
 
-func handleIndex(w http.ResponseWriter, r *http.Request) {
-	var err error
-	var responseID *uuid.UUID
-	innovateFirst := (rand.Float32() > 0.5)
-	err = responseInsertStmt.QueryRow(innovateFirst).Scan(&responseID)
+	id := uuid.New()
+	ra, err := assign(tx, surveyConfig.Design, *surveyID, surveyConfig.Seed, id, participant)
 	if err != nil {
-		log.Printf("unable to create a new uuid: %v", err)
+		log.Printf("unable to assign response: %v\n", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
-
-	var data = struct {
-		QuestionRows []ChatMessage
-		ResponseID   string
-		SurveyID     string
-		ChatTime     int
-	}{
-		QuestionRows: []ChatMessage{},
-		ResponseID:   responseID.String(),
-		SurveyID:     "",
-		ChatTime:     DEFAULT_CHAT_TIME,
+	assignment, err := json.Marshal(ra.Assignment)
+	if err != nil {
+		log.Printf("unable to marshal assignment: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
 	}
 
-	err = tmpls.ExecuteTemplate(w, "index.html", data)
+	var blockNumber, blockIndex *int
+	if ra.Slot != nil {
+		blockNumber, blockIndex = &ra.Slot.Number, &ra.Slot.Index
+	}
+	_, err = tx.Stmt(lucidResponseInsertStmt).Exec(id, responseID, surveyID, panelistID, supplierID, age, zip, gender, hispanic, ethnicity, standardVote,
+		ra.InnovateFirst, ra.Condition, string(assignment), ra.Cell, ra.Stratum, surveyConfig.Seed, blockNumber, blockIndex)
 	if err != nil {
-		log.Printf("error executing template: %v\n", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Printf("error executing lucidResponseInsertStmt: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if ra.Allocation != nil {
+		err = logAllocation(tx, *surveyID, id, ra)
+		if err != nil {
+			log.Printf("unable to log allocation: %v\n", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
 	}
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("unable to commit response: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	renderPreSurvey(w, SurveyResponse{ID: &id, SurveyID: surveyID, Seed: surveyConfig.Seed, Condition: ra.Condition}, surveyConfig.Questionnaire)
 }
 
-func initURLs() {
+func handleIndex(w http.ResponseWriter, r *http.Request) {
 	var err error
-	TEMPLATE_LINK, err = url.Parse("https://ai-debate.org")
-	if err != nil {
-		log.Printf("unable to parse 'https://ai-debate.org'")
+	responseID := uuid.New()
+	seed := newSeed()
+	// Responses without a survey run as debates unless a condition is
+	// requested, which lets each arm be previewed.
+	conditions := DEFAULT_CONDITIONS
+	if condition := r.URL.Query().Get("condition"); condition != "" {
+		if !validCondition(condition) {
+			http.Error(w, "invalid condition parameter", http.StatusBadRequest)
+			return
+		}
+		conditions = []string{condition}
 	}
-	SURVEY_ENDPOINT, err = url.Parse("https://api.samplicio.us/demand/v2-beta/surveys")
+	// There are no survey blocks to draw from.
+	design := defaultDesign(conditions)
+	design.Method = ASSIGN_SIMPLE
+	ra, err := assign(nil, design, uuid.Nil, seed, responseID, Participant{})
 	if err != nil {
-		log.Printf("unable to parse 'https://api.samplicio.us/demand/v2-beta/surveys'")
+		log.Printf("unable to assign response: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
 	}
-	PROJECT_ENDPOINT, err = url.Parse("https://api.samplicio.us/demand/v2-beta/projects")
+	assignment, err := json.Marshal(ra.Assignment)
 	if err != nil {
-		log.Printf("unable to parse 'https://api.samplicio.us/demand/v2-beta/projects'")
+		log.Printf("unable to marshal assignment: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
 	}
-	QUALIFICATION_ENDPOINT, err = url.Parse("https://api.samplicio.us/Demand/v1/SurveyQualifications/Create")
+	_, err = responseInsertStmt.Exec(responseID, ra.InnovateFirst, ra.Condition, string(assignment), ra.Cell, seed)
 	if err != nil {
-		log.Printf("unable to parse 'https://api.samplicio.us/Demand/v1/SurveyQualification/Create'")
+		log.Printf("unable to create a new uuid: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
 	}
-	EXCHANGE_TEMPLATE_ENDPOINT, err = url.Parse("https://api.samplicio.us/ExchangeTemplates/ApplyToSurvey")
-	if err != nil {
-		log.Printf("unable to parse 'https://api.samplicio.us/ExchangeTemplates/ApplyToSurvey'")
+
+	renderPreSurvey(w, SurveyResponse{ID: &responseID, Seed: seed, Condition: ra.Condition}, defaultQuestionnaire)
+}
+
+// initURLs sets the site and Lucid URLs. SITE_URL replaces the site in
+// survey links and LUCID_BASE_URL the Lucid API, such as a lucid-fake server
+// for deploying offline.
+func initURLs() {
+	var err error
+	siteURL := os.Getenv("SITE_URL")
+	if siteURL == "" {
+		siteURL = DEFAULT_SITE_URL
 	}
-	COMPLETE_URL, err = url.Parse("https://notch.insights.supply/cb?token=0433a930-10c5-46e0-b3e9-b99dfce1cdb4")
+	TEMPLATE_LINK, err = url.Parse(siteURL)
 	if err != nil {
-		log.Printf("unable to parse 'https://www.samplicio.us/router/ClientCallBack.aspx'")
+		log.Fatalf("invalid SITE_URL %s: %v\n", siteURL, err)
+	}
+	lucidClient = lucid.New(os.Getenv("LUCIDHQ_API_KEY"))
+	if baseURL := os.Getenv("LUCID_BASE_URL"); baseURL != "" {
+		lucidClient.BaseURL, err = url.Parse(baseURL)
+		if err != nil {
+			log.Fatalf("invalid LUCID_BASE_URL %s: %v\n", baseURL, err)
+		}
 	}
+	initExitURLs()
 }
 
 func main() {
 	// Get current timestamp
 	timestamp := time.Now().Format("2006-01-02_15-04-05")
 
-	initURLs()
-
 	// Create log filename with timestamp
 	logFileName := fmt.Sprintf("app_%s.log", timestamp)
 
@@ -1380,6 +1447,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to load .env: %v\n", err)
 	}
+	initURLs()
 
 	connStr := os.Getenv("POSTGRESQL_CONN_STR")
 	db, err = sql.Open("postgres", connStr)
@@ -1396,84 +1464,83 @@ func main() {
 	db.SetMaxIdleConns(10)
 	db.SetConnMaxLifetime(5 * time.Minute)
 
-	innovationFirstStmt, err = db.Prepare(`SELECT innovate_first FROM response WHERE id = $1;`)
+	responseConditionStmt, err = db.Prepare(`SELECT innovate_first, condition, assignment, COALESCE(seed, 0) FROM response WHERE id = $1;`)
 	if err != nil {
-		log.Fatalf("Failed to prepare innovationFirstStmt: %v", err)
+		log.Fatalf("Failed to prepare responseConditionStmt: %v", err)
 	}
 
-	surveyInsertStmt, err = db.Prepare(`INSERT INTO survey (id, lucid_id, chat_time) VALUES ($1, $2, $3);`)
+	surveyInsertStmt, err = db.Prepare(`
+	INSERT INTO survey (id, lucid_id, chat_time, provider, model_parity, model, temperature, reasoning_effort, max_tokens, stream, bot_settings, prompt_versions, topics, personas, conditions, design, seed, questionnaire, targeting)
+	VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, NULLIF($8, ''), NULLIF($9, 0), $10, $11, $12, $13, $14, $15, $16, $17, $18, $19);`)
 	if err != nil {
 		log.Fatalf("Failed to prepare surveyInsertStmt: %v\n", err)
 	}
 
-	chatTimeQueryStmt, err = db.Prepare("SELECT chat_time FROM survey WHERE id = $1;")
+	surveyConfigQueryStmt, err = db.Prepare(`
+	SELECT chat_time, provider, model_parity, model, temperature, reasoning_effort, max_tokens, stream, bot_settings, prompt_versions, topics, personas, conditions, design, seed, questionnaire
+	FROM survey WHERE id = $1;`)
+	if err != nil {
+		log.Fatalf("Failed to prepare surveyConfigQueryStmt: %v\n", err)
+	}
+
+	responseQueryStmt, err = db.Prepare(`
+	SELECT id, survey_id, response_id, start_time, pre_complete_time, COALESCE(seed, 0), COALESCE(condition, ''), COALESCE(exit_status, '')
+	FROM response WHERE id = $1`)
 	if err != nil {
-		log.Fatalf("Failed to prepare chatTimeQueryStmt: %v\n", err)
+		log.Fatalf("Failed to prepare responseQueryStmt: %v\n", err)
 	}
 
-	responseQueryStmt, err = db.Prepare(`SELECT
-																			 id,
-																			 survey_id,
-																			 response_id,
-																			 start_time,
-	                                     which_llm, 
-	                                     ai_speed, 
-																			 power_x_bad_actor,
-																			 ai_regulation_approach,
-																			 ban_x_no_regulation,
-																			 ban_x_mandates,
-																			 mandates_x_no_regulation,
-	                                     musk_opinion, 
-	                                     patterson_opinion, 
-																			 kensington_opinion, 
-																			 potholes
-																FROM response WHERE id = $1`)
+	answerQueryStmt, err = db.Prepare(`SELECT wave, question_id, value FROM response_answer WHERE response_id = $1`)
 	if err != nil {
-		log.Fatalf("Failed to prepare startTimeStmt: %v\n", err)
+		log.Fatalf("Failed to prepare answerQueryStmt: %v\n", err)
 	}
 
-	responseUpdateStmt, err = db.Prepare(`
-	UPDATE response
-	SET which_llm = $1,
-			ai_speed = $2,
-			power_x_bad_actor = $3,
-			ai_regulation_approach = $4,
-			ban_x_no_regulation = $5,
-			ban_x_mandates = $6,
-			mandates_x_no_regulation = $7,
-			musk_opinion = $8,
-			patterson_opinion = $9,
-			kensington_opinion = $10,
-			potholes = $11
-	WHERE id = $12`)
+	answerUpsertStmt, err = db.Prepare(`
+	INSERT INTO response_answer (response_id, wave, question_id, value, position, presented_order) VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (response_id, wave, question_id) DO UPDATE SET value = EXCLUDED.value, position = EXCLUDED.position,
+		presented_order = EXCLUDED.presented_order, update_time = CURRENT_TIMESTAMP`)
 	if err != nil {
-		log.Fatalf("Failed to prepare responseUpdateStmt: %v\n", err)
+		log.Fatalf("Failed to prepare answerUpsertStmt: %v\n", err)
 	}
 
-	chatHistoryStmt, err = db.Prepare(`SELECT * FROM chat WHERE response_id = $1 ORDER BY created_time;`)
+	answerDeleteStmt, err = db.Prepare(`DELETE FROM response_answer WHERE response_id = $1 AND wave = $2 AND question_id = ANY($3)`)
+	if err != nil {
+		log.Fatalf("Failed to prepare answerDeleteStmt: %v\n", err)
+	}
+
+	chatHistoryStmt, err = db.Prepare(`
+	SELECT chat.id, chat.user_msg, chat_message.persona, chat_message.content
+	FROM chat JOIN chat_message ON chat_message.chat_id = chat.id
+	WHERE chat.response_id = $1
+	ORDER BY chat.created_time, chat_message.position;`)
 	if err != nil {
 		log.Fatalf("Failed to prepare chatHistoryStmt: %v", err)
 	}
 
-	insertChatStmt, err = db.Prepare(`INSERT INTO chat (id, response_id, user_msg, safety_msg, innovation_msg)
-																							VALUES ($1, $2, $3, $4, $5);`)
+	insertChatStmt, err = db.Prepare(`INSERT INTO chat (id, response_id, user_msg) VALUES ($1, $2, $3);`)
+	if err != nil {
+		log.Fatalf("Failed to prepare insertChatStmt: %v", err)
+	}
+
+	insertChatMessageStmt, err = db.Prepare(`
+	INSERT INTO chat_message (chat_id, response_id, persona, position, content, prompt_version, settings, meta)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`)
 	if err != nil {
-		log.Fatalf("Failed to prepare updateChatStmt: %v", err)
+		log.Fatalf("Failed to prepare insertChatMessageStmt: %v", err)
 	}
 
-	responseInsertStmt, err = db.Prepare(`INSERT INTO response (innovate_first) VALUES ($1) RETURNING id`)
+	responseInsertStmt, err = db.Prepare(`INSERT INTO response (id, innovate_first, condition, assignment, cell, seed) VALUES ($1, $2, $3, $4, $5, $6)`)
 	if err != nil {
 		log.Fatalf("Failed to prepare responseInsertStmt %v", err)
 	}
 
-	lucidResponseInsertStmt, err = db.Prepare(`INSERT INTO response (response_id, survey_id, panelist_id, supplier_id, age, zip, gender, hispanic, ethnicity, standard_vote, innovate_first)
-	                                                          VALUES ($1, $2,       $3,         $4,         $5,  $6,  $7,     $8,       $9,        $10,           $11)
-																														RETURNING id`)
+	lucidResponseInsertStmt, err = db.Prepare(`INSERT INTO response (id, response_id, survey_id, panelist_id, supplier_id, age, zip, gender, hispanic, ethnicity, standard_vote, innovate_first, condition, assignment, cell, stratum, seed, block_number, block_index)
+	                                                          VALUES ($1, $2,          $3,        $4,          $5,          $6,  $7,  $8,     $9,       $10,       $11,           $12,            $13,       $14,        $15,  $16,     $17,  $18,          $19)`)
 	if err != nil {
 		log.Fatalf("Failed to prepare lucidResponseInsertStmt: %v", err)
 	}
 
-	chatCountStmt, err = db.Prepare(`SELECT COUNT(*) FROM chat WHERE response_id = $1`)
+	chatCountStmt, err = db.Prepare(`SELECT COUNT(*), MAX(created_time) FROM chat WHERE response_id = $1`)
 	if err != nil {
 		log.Fatalf("Failed to prepare chatCountStmt: %v", err)
 	}
@@ -1483,7 +1550,208 @@ func main() {
 		log.Fatalf("Failed to prepare markIncomplete stmt %v", err)
 	}
 
-	client = openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+	parityAuditStmt, err = db.Prepare(`
+	SELECT chat_message.chat_id, chat_message.response_id, chat_message.persona, chat_message.position, chat_message.settings, response.assignment
+	FROM chat_message JOIN response ON response.id = chat_message.response_id
+	WHERE response.survey_id = $1
+	ORDER BY chat_message.response_id, chat_message.created_time, chat_message.position`)
+	if err != nil {
+		log.Fatalf("Failed to prepare parityAuditStmt: %v", err)
+	}
+
+	blockInitStmt, err = db.Prepare(`
+	INSERT INTO randomization_block (survey_id, stratum) VALUES ($1, $2)
+	ON CONFLICT (survey_id, stratum) DO NOTHING`)
+	if err != nil {
+		log.Fatalf("Failed to prepare blockInitStmt: %v", err)
+	}
+
+	blockQueryStmt, err = db.Prepare(`
+	SELECT block_number, next_index FROM randomization_block
+	WHERE survey_id = $1 AND stratum = $2 FOR UPDATE`)
+	if err != nil {
+		log.Fatalf("Failed to prepare blockQueryStmt: %v", err)
+	}
+
+	blockUpdateStmt, err = db.Prepare(`
+	UPDATE randomization_block SET block_number = $3, next_index = $4, update_time = CURRENT_TIMESTAMP
+	WHERE survey_id = $1 AND stratum = $2`)
+	if err != nil {
+		log.Fatalf("Failed to prepare blockUpdateStmt: %v", err)
+	}
+
+	// Participants turned away over quota were never assigned.
+	balanceStmt, err = db.Prepare(`
+	SELECT COALESCE(cell, ''), COALESCE(stratum, ''), COUNT(*), COUNT(complete_time)
+	FROM response WHERE survey_id = $1 AND exit_status IS DISTINCT FROM 'over_quota'
+	GROUP BY 1, 2 ORDER BY 1, 2`)
+	if err != nil {
+		log.Fatalf("Failed to prepare balanceStmt: %v", err)
+	}
+
+	completeStmt, err = db.Prepare(`UPDATE response SET complete_time = CURRENT_TIMESTAMP WHERE id = $1 AND complete_time IS NULL`)
+	if err != nil {
+		log.Fatalf("Failed to prepare completeStmt: %v", err)
+	}
+
+	exitStmt, err = db.Prepare(`
+	UPDATE response SET exit_status = COALESCE(exit_status, $2), exit_time = COALESCE(exit_time, CURRENT_TIMESTAMP)
+	WHERE id = $1
+	RETURNING exit_status`)
+	if err != nil {
+		log.Fatalf("Failed to prepare exitStmt: %v", err)
+	}
+
+	responseSeedStmt, err = db.Prepare(`SELECT COALESCE(seed, 0) FROM response WHERE id = $1`)
+	if err != nil {
+		log.Fatalf("Failed to prepare responseSeedStmt: %v", err)
+	}
+
+	assignmentAuditStmt, err = db.Prepare(`
+	SELECT response.id, seed, COALESCE(age, 0), gender, hispanic, ethnicity, standard_vote, zip,
+	       response.cell, stratum, condition, innovate_first, block_number, block_index,
+	       allocation_log.arms, allocation_log.burn_in
+	FROM response LEFT JOIN allocation_log ON allocation_log.response_id = response.id
+	WHERE response.survey_id = $1 AND response.exit_status IS DISTINCT FROM 'over_quota'
+	ORDER BY start_time`)
+	if err != nil {
+		log.Fatalf("Failed to prepare assignmentAuditStmt: %v", err)
+	}
+
+	rewardStmt, err = db.Prepare(`
+	SELECT response.cell, COUNT(*) FILTER (WHERE response_answer.value = ANY($3)), COUNT(*) FILTER (WHERE response_answer.value <> ALL($3))
+	FROM response JOIN response_answer ON response_answer.response_id = response.id
+	WHERE response.survey_id = $1 AND response.complete_time IS NOT NULL
+	  AND response_answer.wave = 'post' AND response_answer.question_id = $2 AND response_answer.value <> ALL($4)
+	GROUP BY response.cell`)
+	if err != nil {
+		log.Fatalf("Failed to prepare rewardStmt: %v", err)
+	}
+
+	allocationCountStmt, err = db.Prepare(`SELECT COUNT(*) FROM allocation_log WHERE survey_id = $1`)
+	if err != nil {
+		log.Fatalf("Failed to prepare allocationCountStmt: %v", err)
+	}
+
+	allocationInsertStmt, err = db.Prepare(`
+	INSERT INTO allocation_log (survey_id, response_id, cell, probability, burn_in, arms)
+	VALUES ($1, $2, $3, $4, $5, $6)`)
+	if err != nil {
+		log.Fatalf("Failed to prepare allocationInsertStmt: %v", err)
+	}
+
+	allocationQueryStmt, err = db.Prepare(`
+	SELECT allocation_log.response_id, allocation_log.cell, allocation_log.probability, allocation_log.burn_in,
+	       allocation_log.arms, COALESCE(response_answer.value, ''), response.complete_time IS NOT NULL,
+	       allocation_log.create_time
+	FROM allocation_log JOIN response ON response.id = allocation_log.response_id
+	LEFT JOIN response_answer ON response_answer.response_id = response.id
+	     AND response_answer.wave = 'post' AND response_answer.question_id = $2
+	WHERE allocation_log.survey_id = $1 ORDER BY allocation_log.create_time`)
+	if err != nil {
+		log.Fatalf("Failed to prepare allocationQueryStmt: %v", err)
+	}
+
+	preSurveyCompleteStmt, err = db.Prepare(`UPDATE response SET pre_complete_time = CURRENT_TIMESTAMP WHERE id = $1 AND pre_complete_time IS NULL`)
+	if err != nil {
+		log.Fatalf("Failed to prepare preSurveyCompleteStmt: %v", err)
+	}
+
+	quotaInsertStmt, err = db.Prepare(`
+	INSERT INTO survey_quota (survey_id, question, cell, precodes, quota, lucid_quota_id, position)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`)
+	if err != nil {
+		log.Fatalf("Failed to prepare quotaInsertStmt: %v", err)
+	}
+
+	// Responses are matched to quota cells by the demographic column of
+	// the quota question. Responses that were screened out, over quota or
+	// terminated for quality do not count.
+	quotaFillStmt, err = db.Prepare(`
+	SELECT survey_quota.question, survey_quota.cell, survey_quota.precodes, survey_quota.quota, survey_quota.lucid_quota_id,
+	       COUNT(response.id), COUNT(response.complete_time)
+	FROM survey_quota
+	LEFT JOIN response ON response.survey_id = survey_quota.survey_id AND CASE survey_quota.question
+		WHEN 'AGE' THEN response.age::TEXT
+		WHEN 'GENDER' THEN response.gender
+		WHEN 'HISPANIC' THEN response.hispanic
+		WHEN 'ETHNICITY' THEN response.ethnicity
+		WHEN 'STANDARD_VOTE' THEN response.standard_vote
+		WHEN 'ZIP' THEN response.zip
+	END = ANY(survey_quota.precodes) AND COALESCE(response.exit_status, 'complete') = 'complete'
+	WHERE survey_quota.survey_id = $1
+	GROUP BY survey_quota.survey_id, survey_quota.question, survey_quota.cell
+	ORDER BY survey_quota.position`)
+	if err != nil {
+		log.Fatalf("Failed to prepare quotaFillStmt: %v", err)
+	}
+
+	surveyLucidIDStmt, err = db.Prepare(`SELECT lucid_id FROM survey WHERE id = $1`)
+	if err != nil {
+		log.Fatalf("Failed to prepare surveyLucidIDStmt: %v", err)
+	}
+
+	surveyStatusInsertStmt, err = db.Prepare(`
+	INSERT INTO survey_status (survey_id, action, status, quantity, cpi, error) VALUES ($1, $2, $3, $4, $5, $6)`)
+	if err != nil {
+		log.Fatalf("Failed to prepare surveyStatusInsertStmt: %v", err)
+	}
+
+	surveyStatusQueryStmt, err = db.Prepare(`
+	SELECT action, status, quantity, cpi, error, create_time FROM survey_status WHERE survey_id = $1 ORDER BY create_time`)
+	if err != nil {
+		log.Fatalf("Failed to prepare surveyStatusQueryStmt: %v", err)
+	}
+
+	exportResponseStmt, err = db.Prepare(`
+	SELECT id, COALESCE(response_id, ''), COALESCE(cell, ''), COALESCE(condition, ''), innovate_first,
+	       start_time, pre_complete_time, complete_time, COALESCE(exit_status, '')
+	FROM response WHERE survey_id = $1 ORDER BY start_time`)
+	if err != nil {
+		log.Fatalf("Failed to prepare exportResponseStmt: %v", err)
+	}
+
+	exportAnswerStmt, err = db.Prepare(`
+	SELECT response_answer.response_id, response_answer.wave, response_answer.question_id, response_answer.value,
+	       response_answer.position, response_answer.presented_order
+	FROM response_answer JOIN response ON response.id = response_answer.response_id
+	WHERE response.survey_id = $1`)
+	if err != nil {
+		log.Fatalf("Failed to prepare exportAnswerStmt: %v", err)
+	}
+
+	promptVersionInsertStmt, err = db.Prepare(`INSERT INTO prompt_version (id, name, content) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING`)
+	if err != nil {
+		log.Fatalf("Failed to prepare promptVersionInsertStmt: %v", err)
+	}
+
+	promptVersionQueryStmt, err = db.Prepare(`SELECT name, content FROM prompt_version WHERE id = $1`)
+	if err != nil {
+		log.Fatalf("Failed to prepare promptVersionQueryStmt: %v", err)
+	}
+
+	participantQueryStmt, err = db.Prepare(`
+	SELECT COALESCE(age, 0), gender, hispanic, ethnicity, standard_vote, zip, pre_complete_time
+	FROM response WHERE id = $1`)
+	if err != nil {
+		log.Fatalf("Failed to prepare participantQueryStmt: %v", err)
+	}
+
+	defaultQuestionnaire, err = loadQuestionnaire(QUESTIONNAIRE_FILE)
+	if err != nil {
+		log.Fatalf("failed to load questionnaire: %v\n", err)
+	}
+
+	promptRegistry, err = loadPromptRegistry(PROMPT_FILES)
+	if err != nil {
+		log.Fatalf("failed to load prompts: %v\n", err)
+	}
+	err = promptRegistry.Store()
+	if err != nil {
+		log.Fatalf("failed to store prompt versions: %v\n", err)
+	}
+
+	initProviders()
 
 	r := mux.NewRouter()
 
@@ -1493,7 +1761,18 @@ func main() {
 	r.HandleFunc("/chat", streamResponse)
 	r.HandleFunc("/prompt-suggestion", promptSuggest)
 	r.HandleFunc("/deploy", handleSurveyDeploy)
+	r.HandleFunc("/audit/parity", handleParityAudit)
+	r.HandleFunc("/audit/balance", handleBalance)
+	r.HandleFunc("/audit/assignment", handleAssignmentAudit)
+	r.HandleFunc("/audit/allocation", handleAllocationLog)
+	r.HandleFunc("/export", handleExport)
+	r.HandleFunc("/quotas", handleQuotas)
+	r.HandleFunc("/lifecycle/history", handleStatusHistory)
+	r.HandleFunc("/lifecycle/{action:[a-z]+}", handleLifecycle).Methods("POST")
+	r.HandleFunc("/pre-survey", handlePreSurvey)
+	r.HandleFunc("/debate", handleDebate)
 	r.HandleFunc("/survey", handleSurvey)
+	r.HandleFunc("/exit", handleExit)
 	r.HandleFunc("/", handleIndex)
 	r.HandleFunc("/{surveyID:[a-zA-Z0-9-]+}", handleLucidIndex)
 
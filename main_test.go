@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/loganamcnichols/ai-debate/lucid"
+	"github.com/loganamcnichols/ai-debate/lucid/lucidtest"
+)
+
+const TEST_LUCID_API_KEY = "test-key"
+
+const TEST_TARGETING = `{"quotas": [{"question": "STANDARD_VOTE", "cells": [
+	{"name": "democrat", "precodes": ["1"], "share": 0.5},
+	{"name": "republican", "precodes": ["2", "3"], "share": 0.5}
+]}]}`
+
+// newTestLucid sets the site URLs and points lucidClient at a lucidtest
+// server for the test.
+func newTestLucid(t *testing.T) *lucidtest.Server {
+	t.Helper()
+	server := lucidtest.NewServer(TEST_LUCID_API_KEY)
+	t.Cleanup(server.Close)
+	t.Setenv("LUCIDHQ_API_KEY", TEST_LUCID_API_KEY)
+	previous := lucidClient
+	initURLs()
+	lucidClient = server.LucidClient()
+	t.Cleanup(func() { lucidClient = previous })
+	return server
+}
+
+func newDeployRequest(targeting string) *http.Request {
+	form := url.Values{
+		"chatTime":    {"15"},
+		"prescreens":  {"100"},
+		"lucidLaunch": {"true"},
+		"targeting":   {targeting},
+	}
+	r := httptest.NewRequest("POST", "/deploy", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", TEST_LUCID_API_KEY)
+	return r
+}
+
+// surveyPath is the path of the v1 endpoint for the Lucid survey with
+// lucidID.
+func surveyPath(lucidID int, endpoint string) string {
+	return fmt.Sprintf("/%s/%d", endpoint, lucidID)
+}
+
+func TestLaunchSurvey(t *testing.T) {
+	server := newTestLucid(t)
+	targeting, err := parseTargeting(TEST_TARGETING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas := targeting.surveyQuotas(100)
+	surveyID := uuid.New()
+
+	lucidID, err := launchSurvey(context.Background(), "test", 100, 15, surveyID, targeting, quotas)
+	if err != nil {
+		t.Fatalf("launchSurvey: %v", err)
+	}
+	survey, ok := server.Survey(lucidID)
+	if !ok {
+		t.Fatalf("survey %d was not created", lucidID)
+	}
+	if survey.Status != lucid.STATUS_LIVE {
+		t.Errorf("status = %s, want %s", survey.Status, lucid.STATUS_LIVE)
+	}
+	if len(survey.Qualifications) != len(targeting.qualifications()) {
+		t.Errorf("got %d qualifications, want %d", len(survey.Qualifications), len(targeting.qualifications()))
+	}
+	if len(survey.Quotas) != len(quotas) {
+		t.Errorf("got %d quotas, want %d", len(survey.Quotas), len(quotas))
+	}
+	for _, quota := range quotas {
+		if quota.LucidQuotaID == nil {
+			t.Errorf("quota %s has no Lucid ID", quota.Cell)
+		}
+	}
+	if len(survey.ExchangeTemplates) != 1 || survey.ExchangeTemplates[0] != BLOCKED_VENDOR_TEMPLATE_ID {
+		t.Errorf("exchange templates = %v, want [%d]", survey.ExchangeTemplates, BLOCKED_VENDOR_TEMPLATE_ID)
+	}
+	for _, call := range server.Calls() {
+		if !strings.HasPrefix(call.IdempotencyKey, surveyID.String()+"/") {
+			t.Errorf("%s %s has idempotency key %q", call.Method, call.Path, call.IdempotencyKey)
+		}
+	}
+}
+
+func TestLaunchSurveyRetries(t *testing.T) {
+	server := newTestLucid(t)
+	server.Fail("POST", "/"+lucid.SURVEYS_PATH, http.StatusServiceUnavailable, 1)
+
+	lucidID, err := launchSurvey(context.Background(), "test", 100, 15, uuid.New(), Targeting{}, nil)
+	if err != nil {
+		t.Fatalf("launchSurvey: %v", err)
+	}
+	if survey, _ := server.Survey(lucidID); survey.Status != lucid.STATUS_LIVE {
+		t.Errorf("status = %s, want %s", survey.Status, lucid.STATUS_LIVE)
+	}
+}
+
+func TestSurveyDeployRollsBack(t *testing.T) {
+	lucidID := lucidtest.FIRST_SURVEY_ID
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		// status is the status the survey is rolled back to.
+		status string
+	}{
+		{"qualification", "POST", surveyPath(lucidID, lucid.QUALIFICATIONS_PATH), lucid.STATUS_ARCHIVED},
+		{"quota", "POST", surveyPath(lucidID, lucid.QUOTAS_PATH), lucid.STATUS_ARCHIVED},
+		{"exchange template", "POST", fmt.Sprintf("/%s/%d/%d", lucid.EXCHANGE_TEMPLATES_PATH, lucidID, BLOCKED_VENDOR_TEMPLATE_ID), lucid.STATUS_ARCHIVED},
+		{"live", "PATCH", fmt.Sprintf("/%s/%d", lucid.SURVEYS_PATH, lucidID), lucid.STATUS_PAUSED},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestLucid(t)
+			server.Fail(test.method, test.path, http.StatusBadRequest, 1)
+
+			w := httptest.NewRecorder()
+			handleSurveyDeploy(w, newDeployRequest(TEST_TARGETING))
+
+			if w.Code != http.StatusBadGateway {
+				t.Fatalf("status code = %d, want %d: %s", w.Code, http.StatusBadGateway, w.Body)
+			}
+			survey, ok := server.Survey(lucidID)
+			if !ok {
+				t.Fatalf("survey %d was not created", lucidID)
+			}
+			if survey.Status != test.status {
+				t.Errorf("status = %s, want %s", survey.Status, test.status)
+			}
+		})
+	}
+}
+
+func TestLaunchSurveyRollbackFailure(t *testing.T) {
+	server := newTestLucid(t)
+	path := fmt.Sprintf("/%s/%d", lucid.SURVEYS_PATH, lucidtest.FIRST_SURVEY_ID)
+	// Both the live request and the rollback fail.
+	server.Fail("PATCH", path, http.StatusBadRequest, 2)
+
+	_, err := launchSurvey(context.Background(), "test", 100, 15, uuid.New(), Targeting{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "rolling back survey") {
+		t.Fatalf("error = %v, want a failed rollback", err)
+	}
+	if survey, _ := server.Survey(lucidtest.FIRST_SURVEY_ID); survey.Status == lucid.STATUS_LIVE {
+		t.Errorf("survey is %s", survey.Status)
+	}
+}
+
+func TestSurveyDeployRequiresAuthorization(t *testing.T) {
+	server := newTestLucid(t)
+	r := newDeployRequest("")
+	r.Header.Set("Authorization", "wrong")
+
+	w := httptest.NewRecorder()
+	handleSurveyDeploy(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status code = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if calls := server.Calls(); len(calls) != 0 {
+		t.Errorf("got %d Lucid calls, want none", len(calls))
+	}
+}
+
+func TestSurveyDeployRejectsDesignBotSettings(t *testing.T) {
+	server := newTestLucid(t)
+	r := newDeployRequest("")
+	if err := r.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	r.Form.Set("design", `{"factors": [{"name": "temperature", "levels": [
+		{"name": "cold", "bot_settings": {"InnovateBot": {"temperature": 0}}},
+		{"name": "hot", "bot_settings": {"InnovateBot": {"temperature": 1}}}
+	]}]}`)
+
+	w := httptest.NewRecorder()
+	handleSurveyDeploy(w, r)
+
+	// The default shared parity gives every bot the same settings.
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status code = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+	if calls := server.Calls(); len(calls) != 0 {
+		t.Errorf("got %d Lucid calls, want none", len(calls))
+	}
+}
+
+func TestLucidReplayRequiresAuthorization(t *testing.T) {
+	server := newTestLucid(t)
+	body, err := json.Marshal(newSurveyRequest("test", 0, 100, 15, uuid.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func(apiKey string) int {
+		r, err := http.NewRequest("POST", server.URL+"/"+lucid.SURVEYS_PATH, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", apiKey)
+		r.Header.Set("Idempotency-Key", "create")
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := create(TEST_LUCID_API_KEY); status >= 300 {
+		t.Fatalf("status code = %d, want success", status)
+	}
+	// The reply saved for the key is not replayed to a wrong API key.
+	if status := create("wrong"); status != http.StatusUnauthorized {
+		t.Errorf("status code = %d, want %d", status, http.StatusUnauthorized)
+	}
+}
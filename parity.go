@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// Model parity modes decide how generation settings are assigned to bots.
+const (
+	// PARITY_POSITION gives the first and second speaker of each question
+	// their provider defaults. Since the speaking order flips every question,
+	// each bot alternates between models.
+	PARITY_POSITION = "position"
+	// PARITY_ROLE pins one configuration to each bot for the whole debate.
+	// Bots take the provider defaults of the speaker position matching their
+	// place in the persona list, so the two default models are kept but no
+	// longer swap with the speaking order.
+	PARITY_ROLE = "role"
+	// PARITY_SHARED runs every bot on the same configuration.
+	PARITY_SHARED = "shared"
+)
+
+var PARITY_MODES = []string{PARITY_POSITION, PARITY_ROLE, PARITY_SHARED}
+
+// DEFAULT_PARITY is the mode of surveys deployed without one. Position parity
+// ties the model to the speaking order, which confounds order effects with
+// model effects, so new surveys run every bot on the same configuration.
+// Surveys that set per persona or per bot settings must be deployed with
+// parity=role or parity=position.
+const DEFAULT_PARITY = PARITY_SHARED
+
+var parityAuditStmt *sql.Stmt
+
+// RecordedSettings is what is stored with every bot reply so the
+// configuration that produced it can be checked later.
+type RecordedSettings struct {
+	Provider string `json:"provider"`
+	GenerationSettings
+}
+
+func validParity(mode string) bool {
+	for _, m := range PARITY_MODES {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// validateParity checks that the survey settings, including those set by
+// design levels, can be honoured by mode. Shared parity, the default, rejects
+// any per persona or per bot settings, since it would ignore them.
+func validateParity(mode string, botOverrides map[string]GenerationSettings, personas []Persona, design Design) error {
+	if !validParity(mode) {
+		return fmt.Errorf("unknown parity mode %q", mode)
+	}
+	if mode != PARITY_SHARED {
+		return nil
+	}
+	if len(botOverrides) > 0 {
+		return sharedParityError("per bot settings")
+	}
+	for _, persona := range personas {
+		if persona.Settings != (GenerationSettings{}) {
+			return sharedParityError("settings on persona " + persona.Name)
+		}
+	}
+	for _, factor := range design.Factors {
+		for _, level := range factor.Levels {
+			if len(level.BotSettings) > 0 {
+				return sharedParityError(fmt.Sprintf("per bot settings in level %s of factor %s", level.Name, factor.Name))
+			}
+		}
+	}
+	return nil
+}
+
+// sharedParityError explains that settings are not allowed under shared
+// parity and how to deploy them.
+func sharedParityError(settings string) error {
+	return fmt.Errorf("parity mode %q, the default, runs every bot on the same settings and does not allow %s; deploy with parity=%s or parity=%s", PARITY_SHARED, settings, PARITY_ROLE, PARITY_POSITION)
+}
+
+// BotSettings resolves the settings for persona speaking at position
+// according to the survey's parity mode. Only PARITY_POSITION depends on the
+// speaking order; PARITY_ROLE starts each bot from the defaults of its role
+// and PARITY_SHARED starts every bot from the first speaker defaults.
+func (sc SurveyConfig) BotSettings(persona Persona, position int) GenerationSettings {
+	switch sc.Parity {
+	case PARITY_ROLE:
+		return positionSettings(sc.Provider, sc.role(persona)).
+			Merge(sc.Generation).
+			Merge(persona.Settings).
+			Merge(sc.BotOverrides[persona.Name])
+	case PARITY_SHARED:
+		return positionSettings(sc.Provider, 0).
+			Merge(sc.Generation)
+	}
+	return positionSettings(sc.Provider, position).
+		Merge(sc.Generation).
+		Merge(persona.Settings).
+		Merge(sc.BotOverrides[persona.Name])
+}
+
+// role is the speaker position whose defaults persona takes under
+// PARITY_ROLE. Personas alternate between the first and second speaker
+// defaults in the order the survey lists them.
+func (sc SurveyConfig) role(persona Persona) int {
+	i := slices.IndexFunc(sc.Personas, func(p Persona) bool { return p.Name == persona.Name })
+	if i < 0 {
+		return 0
+	}
+	return i % 2
+}
+
+func (sc SurveyConfig) RecordedSettings(persona Persona, position int) RecordedSettings {
+	return RecordedSettings{
+		Provider:           sc.Provider,
+		GenerationSettings: sc.BotSettings(persona, position),
+	}
+}
+
+// Persona returns the survey's persona called name.
+func (sc SurveyConfig) Persona(name string) (Persona, bool) {
+	for _, persona := range sc.Personas {
+		if persona.Name == name {
+			return persona, true
+		}
+	}
+	return Persona{}, false
+}
+
+type ParityMismatch struct {
+	ChatID     uuid.UUID         `json:"chat_id"`
+	ResponseID uuid.UUID         `json:"response_id"`
+	Bot        string            `json:"bot"`
+	Position   int               `json:"position"`
+	Expected   *RecordedSettings `json:"expected"`
+	Recorded   *RecordedSettings `json:"recorded"`
+}
+
+type ParityAudit struct {
+	SurveyID   uuid.UUID        `json:"survey_id"`
+	Parity     string           `json:"parity"`
+	Checked    int              `json:"checked"`
+	Unrecorded int              `json:"unrecorded"`
+	Mismatches []ParityMismatch `json:"mismatches"`
+	// Inconsistent lists replies whose recorded settings differ from the
+	// first reply the parity mode says must match them. Expected holds the
+	// settings of that first reply. Unlike Mismatches, this does not depend
+	// on the current survey configuration.
+	Inconsistent []ParityMismatch `json:"inconsistent"`
+	// first holds the first recorded settings of each parity group.
+	first map[string]RecordedSettings
+}
+
+// parityGroup is the key of the replies of a response that mode requires to
+// share settings.
+func parityGroup(mode string, mismatch ParityMismatch) string {
+	switch mode {
+	case PARITY_SHARED:
+		return mismatch.ResponseID.String()
+	case PARITY_ROLE:
+		return mismatch.ResponseID.String() + "/" + mismatch.Bot
+	}
+	return fmt.Sprintf("%s/%s/%d", mismatch.ResponseID, mismatch.Bot, mismatch.Position)
+}
+
+// checkConsistency compares recorded with the first reply of its parity
+// group.
+func (audit *ParityAudit) checkConsistency(mismatch ParityMismatch, recorded RecordedSettings) {
+	group := parityGroup(audit.Parity, mismatch)
+	first, ok := audit.first[group]
+	if !ok {
+		audit.first[group] = recorded
+		return
+	}
+	if !reflect.DeepEqual(recorded, first) {
+		mismatch.Expected = &first
+		mismatch.Recorded = &recorded
+		audit.Inconsistent = append(audit.Inconsistent, mismatch)
+	}
+}
+
+// check compares one recorded reply against the configuration the survey
+// declares for it. Replies from a persona the survey no longer declares are
+// reported without an expected configuration.
+func (audit *ParityAudit) check(config SurveyConfig, mismatch ParityMismatch, data []byte) error {
+	audit.Checked++
+	if persona, ok := config.Persona(mismatch.Bot); ok {
+		expected := config.RecordedSettings(persona, mismatch.Position)
+		mismatch.Expected = &expected
+	}
+	if len(data) == 0 {
+		audit.Unrecorded++
+		audit.Mismatches = append(audit.Mismatches, mismatch)
+		return nil
+	}
+	var recorded RecordedSettings
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return fmt.Errorf("unable to decode settings of chat %s: %v", mismatch.ChatID, err)
+	}
+	audit.checkConsistency(mismatch, recorded)
+	if mismatch.Expected == nil || !reflect.DeepEqual(recorded, *mismatch.Expected) {
+		mismatch.Recorded = &recorded
+		audit.Mismatches = append(audit.Mismatches, mismatch)
+	}
+	return nil
+}
+
+// auditParity checks every bot message of a survey against the survey's
+// declared generation settings for the persona and position it was sent at,
+// taking the response's assignment into account. It also checks the recorded
+// settings against each other, so a reply that broke parity is reported even
+// if the survey configuration was changed to match it.
+func auditParity(surveyID uuid.UUID) (*ParityAudit, error) {
+	var config SurveyConfig
+	err := config.Scan(surveyConfigQueryStmt.QueryRow(surveyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get survey config: %v", err)
+	}
+	audit := &ParityAudit{
+		SurveyID:     surveyID,
+		Parity:       config.Parity,
+		Mismatches:   []ParityMismatch{},
+		Inconsistent: []ParityMismatch{},
+		first:        map[string]RecordedSettings{},
+	}
+
+	rows, err := parityAuditStmt.Query(surveyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute parityAuditStmt: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mismatch ParityMismatch
+		var settings, assignmentData []byte
+		err := rows.Scan(&mismatch.ChatID, &mismatch.ResponseID, &mismatch.Bot, &mismatch.Position, &settings, &assignmentData)
+		if err != nil {
+			return nil, err
+		}
+		assignment, err := scanAssignment(assignmentData)
+		if err != nil {
+			return nil, err
+		}
+		// Each response sees the survey configuration through its assignment.
+		if err := audit.check(config.WithAssignment(assignment), mismatch, settings); err != nil {
+			return nil, err
+		}
+	}
+	return audit, rows.Err()
+}
+
+func handleParityAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != os.Getenv("LUCIDHQ_API_KEY") {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	surveyID, err := uuid.Parse(r.URL.Query().Get("survey-id"))
+	if err != nil {
+		log.Printf("unable to parse survey-id %s: %v\n", r.URL.Query().Get("survey-id"), err)
+		http.Error(w, "invalid survey-id parameter", http.StatusBadRequest)
+		return
+	}
+	audit, err := auditParity(surveyID)
+	if err != nil {
+		log.Printf("failed to audit parity: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(audit)
+	if err != nil {
+		log.Printf("unable to encode parity audit: %v\n", err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+)
+
+var insertChatMessageStmt *sql.Stmt
+
+// Persona names end up in SSE event names, HTML attributes and the OpenAI
+// message name field, so they are restricted to what all three accept.
+var personaNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Persona is one debater.
+type Persona struct {
+	// Name identifies the persona in events, storage and the chat history.
+	Name string `json:"name"`
+	// Label is how the persona is introduced in the conversation.
+	Label string `json:"label,omitempty"`
+	// Prompt is the name of the system prompt in the prompt registry.
+	Prompt string `json:"prompt"`
+	// Settings override the survey generation settings for this persona.
+	Settings GenerationSettings `json:"settings,omitempty"`
+}
+
+var DEFAULT_PERSONAS = []Persona{
+	{Name: "InnovateBot", Label: "Innovate Bot", Prompt: INNOVATION_PROMPT},
+	{Name: "SafetyBot", Label: "Safety Bot", Prompt: SAFETY_PROMPT},
+}
+
+func (p Persona) DisplayLabel() string {
+	if p.Label == "" {
+		return p.Name
+	}
+	return p.Label
+}
+
+// BotReply is one persona's answer to a question.
+type BotReply struct {
+	Persona  Persona
+	Position int
+	Content  string
+	Prompt   Prompt
+	Settings RecordedSettings
+	Meta     GenerationMeta
+}
+
+func validatePersonas(personas []Persona) error {
+	if len(personas) == 0 {
+		return errors.New("at least one persona is required")
+	}
+	seen := map[string]bool{}
+	for _, persona := range personas {
+		if !personaNamePattern.MatchString(persona.Name) {
+			return fmt.Errorf("invalid persona name %q", persona.Name)
+		}
+		if reservedPersonaName(persona.Name) {
+			return fmt.Errorf("persona name %q is reserved", persona.Name)
+		}
+		if seen[persona.Name] {
+			return fmt.Errorf("duplicate persona name %q", persona.Name)
+		}
+		seen[persona.Name] = true
+		if _, err := promptRegistry.Get(persona.Prompt, ""); err != nil {
+			return fmt.Errorf("persona %s: %v", persona.Name, err)
+		}
+		if err := persona.Settings.Validate(); err != nil {
+			return fmt.Errorf("persona %s: %v", persona.Name, err)
+		}
+	}
+	return nil
+}
+
+// reservedPersonaName reports whether name is already used in the chat
+// history by the participant, the reading step or the neutral condition's
+// persona.
+func reservedPersonaName(name string) bool {
+	return name == "user" || name == READING_ROLE || name == NEUTRAL_PERSONA.Name
+}
+
+// parsePersonas decodes the personas JSON array sent to /deploy. An empty
+// parameter keeps the default two debaters.
+func parsePersonas(param string) ([]Persona, error) {
+	if param == "" {
+		return DEFAULT_PERSONAS, nil
+	}
+	var personas []Persona
+	if err := json.Unmarshal([]byte(param), &personas); err != nil {
+		return nil, fmt.Errorf("invalid personas: %v", err)
+	}
+	return personas, validatePersonas(personas)
+}
+
+// rotationOffset converts the response's innovate_first flag into the index
+// of the persona that answers the first question.
+func rotationOffset(innovateFirst bool) int {
+	if innovateFirst {
+		return 0
+	}
+	return 1
+}
+
+// speakingOrder returns the personas in the order they answer the question
+// at index. The first speaker rotates by one persona every question.
+func speakingOrder(personas []Persona, index int) []Persona {
+	order := make([]Persona, len(personas))
+	for i := range personas {
+		order[i] = personas[(index+i)%len(personas)]
+	}
+	return order
+}
+
+// BotPrompt returns the prompt persona speaks with in this survey.
+func (sc SurveyConfig) BotPrompt(persona Persona) (Prompt, error) {
+	return promptRegistry.Get(persona.Prompt, sc.PromptVersions[persona.Prompt])
+}
+
+// opponents lists the names of every speaker other than persona.
+func opponents(speakers []Persona, persona Persona) []string {
+	var names []string
+	for _, speaker := range speakers {
+		if speaker.Name != persona.Name {
+			names = append(names, speaker.Name)
+		}
+	}
+	return names
+}
+
+// generateReply streams persona's answer to the conversation in messages.
+// messages[0] is replaced with the persona's system prompt.
+func generateReply(w http.ResponseWriter, sc SurveyConfig, persona Persona, position int,
+	messages []openai.ChatCompletionMessage, promptContext PromptContext, questionID uuid.UUID) (BotReply, error) {
+	reply := BotReply{
+		Persona:  persona,
+		Position: position,
+		Settings: sc.RecordedSettings(persona, position),
+	}
+	settings := reply.Settings.GenerationSettings
+
+	provider, err := newProvider(sc.Provider, settings.Model)
+	if err != nil {
+		return reply, fmt.Errorf("unable to create provider for %s: %v", persona.Name, err)
+	}
+	reply.Prompt, err = sc.BotPrompt(persona)
+	if err != nil {
+		return reply, fmt.Errorf("unable to get prompt for %s: %v", persona.Name, err)
+	}
+
+	promptContext = promptContext.withTopic(reply.Prompt.Name)
+	promptContext.BotName = persona.Name
+	promptContext.Opponents = opponents(promptContext.Speakers, persona)
+	promptContext.Opponent = strings.Join(promptContext.Opponents, " and ")
+	systemPrompt, err := reply.Prompt.Render(promptContext)
+	if err != nil {
+		return reply, err
+	}
+	messages[0] = openai.ChatCompletionMessage{
+		Role:    "system",
+		Content: systemPrompt,
+	}
+
+	reply.Meta = newGenerationMeta(provider, reply.Prompt)
+	stream, err := provider.CreateChatStream(context.Background(), newChatRequest(messages, settings))
+	if err != nil {
+		return reply, fmt.Errorf("%s stream error: %v", provider.Name(), err)
+	}
+	defer stream.Close()
+
+	msg := ChatMessage{
+		QuestionID: questionID,
+		Role:       persona.Name,
+	}
+	reply.Content, err = streamOpenaiResponse(w, stream, msg, settings.Streaming(), &reply.Meta)
+	if err != nil {
+		return reply, fmt.Errorf("error streaming %s response: %v", provider.Name(), err)
+	}
+	return reply, nil
+}
+
+// insertChat stores a question and every bot reply to it.
+func insertChat(questionID uuid.UUID, responseID uuid.UUID, userMsg string, replies []BotReply) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Stmt(insertChatStmt).Exec(questionID, responseID, userMsg)
+	if err != nil {
+		return fmt.Errorf("error executing insertChatStmt: %v", err)
+	}
+	for _, reply := range replies {
+		settings, err := json.Marshal(reply.Settings)
+		if err != nil {
+			return fmt.Errorf("unable to marshal settings for %s: %v", reply.Persona.Name, err)
+		}
+		meta, err := json.Marshal(reply.Meta)
+		if err != nil {
+			return fmt.Errorf("unable to marshal generation meta for %s: %v", reply.Persona.Name, err)
+		}
+		_, err = tx.Stmt(insertChatMessageStmt).Exec(
+			questionID,
+			responseID,
+			reply.Persona.Name,
+			reply.Position,
+			reply.Content,
+			reply.Prompt.Version,
+			string(settings),
+			string(meta),
+		)
+		if err != nil {
+			return fmt.Errorf("error executing insertChatMessageStmt: %v", err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+)
+
+// useFakeProvider loads the prompts and replaces the fake provider settings
+// with config for the test.
+func useFakeProvider(t *testing.T, config *FakeConfig) SurveyConfig {
+	t.Helper()
+	registry, err := loadPromptRegistry(PROMPT_FILES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousRegistry, previousConfig := promptRegistry, fakeConfig
+	promptRegistry, fakeConfig = registry, config
+	t.Cleanup(func() { promptRegistry, fakeConfig = previousRegistry, previousConfig })
+
+	sc := defaultSurveyConfig()
+	sc.Provider = FAKE_PROVIDER
+	return sc
+}
+
+// generateTestReply has persona answer userMsg at position and returns the
+// reply with the events streamed.
+func generateTestReply(sc SurveyConfig, persona Persona, position int, userMsg string) (BotReply, string, error) {
+	w := httptest.NewRecorder()
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem},
+		{Role: openai.ChatMessageRoleUser, Content: userMsg},
+	}
+	promptContext := PromptContext{
+		Speakers:     sc.Personas,
+		topic:        sc.Topics[0],
+		Section:      1,
+		SectionCount: len(sc.Topics),
+		Turn:         1,
+	}
+	reply, err := generateReply(w, sc, persona, position, messages, promptContext, uuid.New())
+	return reply, w.Body.String(), err
+}
+
+func TestGenerateReply(t *testing.T) {
+	sc := useFakeProvider(t, newTestFakeConfig())
+	persona := sc.Personas[0]
+
+	reply, events, err := generateTestReply(sc, persona, 0, "why?")
+	if err != nil {
+		t.Fatalf("generateReply: %v", err)
+	}
+	if want := "fake-first answers why?"; reply.Content != want {
+		t.Errorf("content = %q, want %q", reply.Content, want)
+	}
+	if !strings.Contains(events, "-"+persona.Name+"\ndata: ") {
+		t.Errorf("no %s event in %q", persona.Name, events)
+	}
+	// Each of the three words is streamed, then the whole reply.
+	if got := strings.Count(events, "event: "); got != 4 {
+		t.Errorf("got %d events, want 4", got)
+	}
+	if reply.Meta.Provider != FAKE_PROVIDER || reply.Meta.FinishReason != "stop" || reply.Meta.CompletionTokens != 3 {
+		t.Errorf("unexpected meta %+v", reply.Meta)
+	}
+	if reply.Prompt.Name != persona.Prompt || reply.Meta.PromptVersion != reply.Prompt.Version {
+		t.Errorf("reply recorded prompt %s %s, meta %s", reply.Prompt.Name, reply.Prompt.Version, reply.Meta.PromptVersion)
+	}
+}
+
+func TestGenerateReplyWithoutStreaming(t *testing.T) {
+	sc := useFakeProvider(t, newTestFakeConfig())
+	stream := false
+	sc.Generation.Stream = &stream
+
+	reply, events, err := generateTestReply(sc, sc.Personas[0], 0, "why?")
+	if err != nil {
+		t.Fatalf("generateReply: %v", err)
+	}
+	if got := strings.Count(events, "event: "); got != 1 {
+		t.Errorf("got %d events, want only the complete reply", got)
+	}
+	if !strings.Contains(events, reply.Content) {
+		t.Errorf("events %q do not contain the reply %q", events, reply.Content)
+	}
+}
+
+func TestGenerateReplyParity(t *testing.T) {
+	tests := []struct {
+		parity string
+		// models[persona][position] is the model the persona speaks with.
+		models [2][2]string
+	}{
+		{PARITY_POSITION, [2][2]string{{"fake-first", "fake-second"}, {"fake-first", "fake-second"}}},
+		{PARITY_ROLE, [2][2]string{{"fake-first", "fake-first"}, {"fake-second", "fake-second"}}},
+		{PARITY_SHARED, [2][2]string{{"fake-first", "fake-first"}, {"fake-first", "fake-first"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.parity, func(t *testing.T) {
+			sc := useFakeProvider(t, newTestFakeConfig())
+			sc.Parity = test.parity
+			for i, persona := range sc.Personas {
+				for position := range 2 {
+					reply, _, err := generateTestReply(sc, persona, position, "why?")
+					if err != nil {
+						t.Fatalf("generateReply: %v", err)
+					}
+					want := test.models[i][position]
+					if reply.Settings.Model != want || reply.Meta.Model != want {
+						t.Errorf("%s at %d recorded %s and ran %s, want %s", persona.Name, position, reply.Settings.Model, reply.Meta.Model, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateReplyInjectedFailure(t *testing.T) {
+	for _, midStream := range []bool{false, true} {
+		config := newTestFakeConfig()
+		config.FailEvery = 2
+		config.FailMidStream = midStream
+		sc := useFakeProvider(t, config)
+		if _, _, err := generateTestReply(sc, sc.Personas[0], 0, "why?"); err != nil {
+			t.Fatalf("first reply: %v", err)
+		}
+		_, _, err := generateTestReply(sc, sc.Personas[0], 0, "why?")
+		// generateReply formats the provider error into its own.
+		if err == nil || !strings.Contains(err.Error(), errFakeInjected.Error()) {
+			t.Errorf("mid stream %t: error = %v, want the injected failure", midStream, err)
+		}
+	}
+}
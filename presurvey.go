@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var preSurveyCompleteStmt *sql.Stmt
+
+// chatPageData is the data for index.html.
+type chatPageData struct {
+	QuestionRows []ChatMessage
+	ResponseID   string
+	SurveyID     string
+	ChatTime     int
+	// Remaining is the number of seconds left in the chat, counted from the
+	// completion of the pre-survey.
+	Remaining int
+}
+
+// handlePreSurvey shows and saves the pre wave of the questionnaire. Once
+// the last page is answered the chat unlocks and the participant is sent to
+// /debate.
+func handlePreSurvey(w http.ResponseWriter, r *http.Request) {
+	serveWave(w, r, WAVE_PRE, func(w http.ResponseWriter, r *http.Request, survey SurveyResponse) {
+		_, err := preSurveyCompleteStmt.Exec(survey.ID)
+		if err != nil {
+			log.Printf("failed to execute preSurveyCompleteStmt: %v\n", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("HX-Redirect", "/debate?response-id="+survey.ID.String())
+	})
+}
+
+// handleDebate shows the chat page of a response whose pre-survey is
+// complete, and the pre-survey otherwise.
+func handleDebate(w http.ResponseWriter, r *http.Request) {
+	ID, err := uuid.Parse(r.URL.Query().Get("response-id"))
+	if err != nil {
+		log.Printf("unable to parse reponse id %s: %v\n", r.URL.Query().Get("response-id"), err)
+		http.Error(w, "invalid response-id", http.StatusBadRequest)
+		return
+	}
+	var survey SurveyResponse
+	err = survey.Scan(responseQueryStmt.QueryRow(ID))
+	if err != nil {
+		log.Printf("error scanning survey response: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if survey.ExitStatus != "" {
+		exitSurvey(w, r, survey, survey.ExitStatus)
+		return
+	}
+	surveyConfig := defaultSurveyConfig()
+	if survey.SurveyID != nil {
+		err = surveyConfig.Scan(surveyConfigQueryStmt.QueryRow(survey.SurveyID))
+		if err != nil {
+			log.Printf("error executing surveyConfig query: %v\n", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if survey.PreCompleteTime == nil {
+		err = survey.LoadAnswers(WAVE_PRE)
+		if err != nil {
+			log.Printf("unable to load answers: %v\n", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		renderPreSurvey(w, survey, surveyConfig.Questionnaire)
+		return
+	}
+
+	data := chatPageData{
+		QuestionRows: []ChatMessage{},
+		ResponseID:   ID.String(),
+		ChatTime:     surveyConfig.ChatTime,
+	}
+	chatEnd := survey.PreCompleteTime.Add(time.Duration(surveyConfig.ChatTime) * time.Minute)
+	data.Remaining = max(int(time.Until(chatEnd).Seconds()), 0)
+	if survey.SurveyID != nil {
+		data.SurveyID = survey.SurveyID.String()
+	}
+	err = tmpls.ExecuteTemplate(w, "index.html", data)
+	if err != nil {
+		log.Printf("error executing template: %v\n", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// renderPreSurvey shows the first pre-survey page.
+func renderPreSurvey(w http.ResponseWriter, survey SurveyResponse, questionnaire Questionnaire) {
+	if survey.Answers == nil {
+		survey.Answers = map[string]string{}
+	}
+	page := newSurveyPage(survey, WAVE_PRE, questionnaire.Pre, 1, nil)
+	err := tmpls.ExecuteTemplate(w, "pre-survey.html", page)
+	if err != nil {
+		log.Printf("error executing template: %v\n", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	INNOVATION_PROMPT = "innovation"
+	SAFETY_PROMPT     = "safety"
+	NEUTRAL_PROMPT    = "neutral"
+)
+
+// PROMPT_FILES are the prompts loaded into the registry at startup.
+var PROMPT_FILES = map[string]string{
+	INNOVATION_PROMPT: "PRO_INNOVATION_PROMPT.txt",
+	SAFETY_PROMPT:     "PRO_SAFETY_PROMPT.txt",
+	NEUTRAL_PROMPT:    "NEUTRAL_PROMPT.txt",
+}
+
+var (
+	promptVersionInsertStmt *sql.Stmt
+	promptVersionQueryStmt  *sql.Stmt
+	participantQueryStmt    *sql.Stmt
+)
+
+var promptRegistry *PromptRegistry
+
+// Prompt is one version of a named system prompt. The content is a
+// text/template rendered with a PromptContext on every turn.
+type Prompt struct {
+	Name     string
+	Version  string
+	Content  string
+	template *texttemplate.Template
+}
+
+// Participant is the demographic data captured from the Lucid entry link.
+type Participant struct {
+	Age          int
+	Gender       string
+	Hispanic     string
+	Ethnicity    string
+	StandardVote string
+	Zip          string
+}
+
+// PromptContext is the data available to prompt templates.
+type PromptContext struct {
+	BotName string
+	// Opponent joins the names of the other debaters with "and". Opponents
+	// lists them separately for debates with more than two personas.
+	Opponent  string
+	Opponents []string
+	// Speakers are the personas answering this question in speaking order.
+	Speakers         []Persona
+	Topic            PromptTopic
+	Section          int
+	SectionCount     int
+	Turn             int
+	MinutesRemaining int
+	Participant      Participant
+
+	topic Topic
+}
+
+// PromptTopic is the current topic as seen by one prompt.
+type PromptTopic struct {
+	Title string
+	// Answer is the answer the topic gives the prompt to open with, or
+	// empty if it has none.
+	Answer string
+}
+
+func (t PromptTopic) String() string {
+	return t.Title
+}
+
+// withTopic returns ctx with the current topic as seen by prompt.
+func (ctx PromptContext) withTopic(prompt string) PromptContext {
+	ctx.Topic = PromptTopic{Title: ctx.topic.Title, Answer: ctx.topic.Answers[prompt]}
+	return ctx
+}
+
+func newPrompt(name string, version string, content string) (Prompt, error) {
+	tmpl, err := texttemplate.New(name).Option("missingkey=error").Parse(content)
+	if err != nil {
+		return Prompt{}, fmt.Errorf("unable to parse prompt %s version %s: %v", name, version, err)
+	}
+	return Prompt{
+		Name:     name,
+		Version:  version,
+		Content:  content,
+		template: tmpl,
+	}, nil
+}
+
+// Render executes the prompt template for one turn of the debate.
+func (p Prompt) Render(ctx PromptContext) (string, error) {
+	var sb strings.Builder
+	if err := p.template.Execute(&sb, ctx); err != nil {
+		return "", fmt.Errorf("unable to render prompt %s version %s: %v", p.Name, p.Version, err)
+	}
+	return sb.String(), nil
+}
+
+// PromptRegistry holds the prompts loaded from disk and caches any older
+// versions that surveys have pinned.
+type PromptRegistry struct {
+	mu       sync.RWMutex
+	current  map[string]Prompt
+	versions map[string]Prompt
+}
+
+// promptVersion identifies a prompt by a short hash of its content.
+func promptVersion(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// loadPromptRegistry reads every prompt file once. A missing or empty file is
+// an error rather than a silently empty system prompt.
+func loadPromptRegistry(files map[string]string) (*PromptRegistry, error) {
+	reg := &PromptRegistry{
+		current:  map[string]Prompt{},
+		versions: map[string]Prompt{},
+	}
+	for name, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read prompt %s: %v", name, err)
+		}
+		if len(content) == 0 {
+			return nil, fmt.Errorf("prompt %s in %s is empty", name, file)
+		}
+		prompt, err := newPrompt(name, promptVersion(content), string(content))
+		if err != nil {
+			return nil, err
+		}
+		reg.current[name] = prompt
+		reg.versions[prompt.Version] = prompt
+	}
+	return reg, nil
+}
+
+// Store saves the current version of every prompt so transcripts can be
+// reproduced after the files change.
+func (reg *PromptRegistry) Store() error {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	for _, prompt := range reg.current {
+		_, err := promptVersionInsertStmt.Exec(prompt.Version, prompt.Name, prompt.Content)
+		if err != nil {
+			return fmt.Errorf("failed to store prompt %s version %s: %v", prompt.Name, prompt.Version, err)
+		}
+	}
+	return nil
+}
+
+// Get returns the prompt called name at version, or the current version when
+// version is empty. Versions that are no longer on disk are read from the
+// database.
+func (reg *PromptRegistry) Get(name string, version string) (Prompt, error) {
+	reg.mu.RLock()
+	if version == "" {
+		prompt, ok := reg.current[name]
+		reg.mu.RUnlock()
+		if !ok {
+			return prompt, fmt.Errorf("unknown prompt %s", name)
+		}
+		return prompt, nil
+	}
+	prompt, ok := reg.versions[version]
+	reg.mu.RUnlock()
+
+	if !ok {
+		var storedName, content string
+		err := promptVersionQueryStmt.QueryRow(version).Scan(&storedName, &content)
+		if errors.Is(err, sql.ErrNoRows) {
+			return prompt, fmt.Errorf("unknown prompt version %s", version)
+		}
+		if err != nil {
+			return prompt, fmt.Errorf("failed to query prompt version %s: %v", version, err)
+		}
+		prompt, err = newPrompt(storedName, version, content)
+		if err != nil {
+			return prompt, err
+		}
+		reg.mu.Lock()
+		reg.versions[version] = prompt
+		reg.mu.Unlock()
+	}
+	if prompt.Name != name {
+		return prompt, fmt.Errorf("prompt version %s belongs to %s, not %s", version, prompt.Name, name)
+	}
+	return prompt, nil
+}
+
+// parsePromptVersions decodes the prompt name to version JSON object sent to
+// /deploy and checks every pinned version exists.
+func parsePromptVersions(param string) (map[string]string, error) {
+	versions := map[string]string{}
+	if param == "" {
+		return versions, nil
+	}
+	if err := json.Unmarshal([]byte(param), &versions); err != nil {
+		return nil, fmt.Errorf("invalid promptVersions: %v", err)
+	}
+	for name, version := range versions {
+		if _, err := promptRegistry.Get(name, version); err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+// queryParticipant reads the demographics of a response and the time its
+// chat unlocked, which is nil until the pre-survey is complete.
+func queryParticipant(responseID uuid.UUID) (Participant, *time.Time, error) {
+	var participant Participant
+	var chatStart *time.Time
+	err := participantQueryStmt.QueryRow(responseID).Scan(
+		&participant.Age,
+		&participant.Gender,
+		&participant.Hispanic,
+		&participant.Ethnicity,
+		&participant.StandardVote,
+		&participant.Zip,
+		&chatStart,
+	)
+	return participant, chatStart, err
+}
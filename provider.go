@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	OPENAI_PROVIDER    = "openai"
+	ANTHROPIC_PROVIDER = "anthropic"
+	LOCAL_PROVIDER     = "local"
+)
+
+const (
+	DEFAULT_ANTHROPIC_BASE_URL   = "https://api.anthropic.com"
+	DEFAULT_ANTHROPIC_MODEL      = "claude-3-5-haiku-latest"
+	DEFAULT_ANTHROPIC_MAX_TOKENS = 1024
+	ANTHROPIC_VERSION            = "2023-06-01"
+)
+
+// Usage is the token accounting reported by a provider once a stream finishes.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	ReasoningTokens  int
+}
+
+// ChatRequest is the provider independent form of a chat completion request.
+// The first message is expected to be the system prompt.
+type ChatRequest struct {
+	Messages        []openai.ChatCompletionMessage
+	Temperature     *float32
+	ReasoningEffort string
+	MaxTokens       int
+}
+
+func newChatRequest(messages []openai.ChatCompletionMessage, gs GenerationSettings) ChatRequest {
+	return ChatRequest{
+		Messages:        messages,
+		Temperature:     gs.Temperature,
+		ReasoningEffort: gs.ReasoningEffort,
+		MaxTokens:       gs.MaxTokens,
+	}
+}
+
+// ChatStream yields the content deltas of a streaming completion. Recv returns
+// io.EOF once the completion is done, after which Usage and FinishReason are
+// populated.
+type ChatStream interface {
+	Recv() (string, error)
+	Usage() Usage
+	FinishReason() string
+	Close() error
+}
+
+// Provider is an LLM backend that can stream chat completions for one model.
+type Provider interface {
+	Name() string
+	Model() string
+	CreateChatStream(ctx context.Context, req ChatRequest) (ChatStream, error)
+}
+
+// providerDefaults holds the models used for the first and second speaker of
+// each question when a survey does not say otherwise.
+type providerDefaults struct {
+	FirstModel           string
+	SecondModel          string
+	FirstReasoningEffort string
+}
+
+var PROVIDER_DEFAULTS = map[string]providerDefaults{
+	OPENAI_PROVIDER: {
+		FirstModel:           openai.O3Mini,
+		SecondModel:          openai.GPT4oMini20240718,
+		FirstReasoningEffort: "low",
+	},
+	ANTHROPIC_PROVIDER: {
+		FirstModel:  DEFAULT_ANTHROPIC_MODEL,
+		SecondModel: DEFAULT_ANTHROPIC_MODEL,
+	},
+	// The local model is filled in by initProviders once the env is loaded.
+	LOCAL_PROVIDER: {},
+	FAKE_PROVIDER: {
+		FirstModel:  "fake-first",
+		SecondModel: "fake-second",
+	},
+}
+
+var localClient *openai.Client
+var anthropicClient *AnthropicClient
+
+// providerOverride, when set through LLM_PROVIDER, replaces the provider of
+// every survey. Setting it to "fake" runs the whole chat flow offline.
+var providerOverride string
+
+// initProviders creates the clients for every provider that has been
+// configured through the environment.
+func initProviders() {
+	client = openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+
+	if baseURL := os.Getenv("LOCAL_LLM_BASE_URL"); baseURL != "" {
+		config := openai.DefaultConfig(os.Getenv("LOCAL_LLM_API_KEY"))
+		config.BaseURL = baseURL
+		localClient = openai.NewClientWithConfig(config)
+	}
+	PROVIDER_DEFAULTS[LOCAL_PROVIDER] = providerDefaults{
+		FirstModel:  os.Getenv("LOCAL_LLM_MODEL"),
+		SecondModel: os.Getenv("LOCAL_LLM_MODEL"),
+	}
+
+	if apiKey := os.Getenv("ANTHROPIC_API_KEY"); apiKey != "" {
+		baseURL := os.Getenv("ANTHROPIC_BASE_URL")
+		if baseURL == "" {
+			baseURL = DEFAULT_ANTHROPIC_BASE_URL
+		}
+		anthropicClient = &AnthropicClient{
+			BaseURL:    strings.TrimSuffix(baseURL, "/"),
+			APIKey:     apiKey,
+			HTTPClient: &http.Client{},
+		}
+	}
+
+	var err error
+	fakeConfig, err = loadFakeConfig()
+	if err != nil {
+		log.Fatalf("failed to load fake provider config: %v\n", err)
+	}
+
+	providerOverride = os.Getenv("LLM_PROVIDER")
+	if providerOverride != "" && !validProvider(providerOverride) {
+		log.Fatalf("invalid LLM_PROVIDER %s\n", providerOverride)
+	}
+}
+
+func validProvider(name string) bool {
+	_, ok := PROVIDER_DEFAULTS[name]
+	return ok
+}
+
+// newProvider returns the provider called name bound to model.
+func newProvider(name string, model string) (Provider, error) {
+	switch name {
+	case OPENAI_PROVIDER:
+		return &OpenAIProvider{client: client, model: model, includeUsage: true}, nil
+	case LOCAL_PROVIDER:
+		if localClient == nil {
+			return nil, errors.New("LOCAL_LLM_BASE_URL is not set")
+		}
+		return &OpenAIProvider{name: LOCAL_PROVIDER, client: localClient, model: model}, nil
+	case ANTHROPIC_PROVIDER:
+		if anthropicClient == nil {
+			return nil, errors.New("ANTHROPIC_API_KEY is not set")
+		}
+		return &AnthropicProvider{client: anthropicClient, model: model}, nil
+	case FAKE_PROVIDER:
+		return &FakeProvider{config: fakeConfig, model: model}, nil
+	}
+	return nil, fmt.Errorf("unknown provider %q", name)
+}
+
+// OpenAIProvider talks to the OpenAI API or any endpoint that implements the
+// OpenAI chat completions API.
+type OpenAIProvider struct {
+	name         string
+	client       *openai.Client
+	model        string
+	includeUsage bool
+}
+
+func (p *OpenAIProvider) Name() string {
+	if p.name == "" {
+		return OPENAI_PROVIDER
+	}
+	return p.name
+}
+
+func (p *OpenAIProvider) Model() string {
+	return p.model
+}
+
+func (p *OpenAIProvider) CreateChatStream(ctx context.Context, req ChatRequest) (ChatStream, error) {
+	openaiReq := openai.ChatCompletionRequest{
+		Model:               p.model,
+		Messages:            req.Messages,
+		Stream:              true,
+		ReasoningEffort:     req.ReasoningEffort,
+		MaxCompletionTokens: req.MaxTokens,
+	}
+	// Local servers generally only know the older max_tokens parameter.
+	if p.Name() == LOCAL_PROVIDER {
+		openaiReq.MaxCompletionTokens = 0
+		openaiReq.MaxTokens = req.MaxTokens
+	}
+	if req.Temperature != nil {
+		openaiReq.Temperature = *req.Temperature
+	}
+	// Not every OpenAI compatible server understands stream_options.
+	if p.includeUsage {
+		openaiReq.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+	stream, err := p.client.CreateChatCompletionStream(ctx, openaiReq)
+	if err != nil {
+		return nil, err
+	}
+	return &openaiChatStream{stream: stream}, nil
+}
+
+type openaiChatStream struct {
+	stream       *openai.ChatCompletionStream
+	usage        Usage
+	finishReason string
+}
+
+func (s *openaiChatStream) Recv() (string, error) {
+	res, err := s.stream.Recv()
+	if err != nil {
+		return "", err
+	}
+	if res.Usage != nil {
+		s.usage.PromptTokens = res.Usage.PromptTokens
+		s.usage.CompletionTokens = res.Usage.CompletionTokens
+		if res.Usage.CompletionTokensDetails != nil {
+			s.usage.ReasoningTokens = res.Usage.CompletionTokensDetails.ReasoningTokens
+		}
+	}
+	// The usage chunk has no choices.
+	if len(res.Choices) == 0 {
+		return "", nil
+	}
+	if res.Choices[0].FinishReason != "" {
+		s.finishReason = string(res.Choices[0].FinishReason)
+	}
+	return res.Choices[0].Delta.Content, nil
+}
+
+func (s *openaiChatStream) Usage() Usage {
+	return s.usage
+}
+
+func (s *openaiChatStream) FinishReason() string {
+	return s.finishReason
+}
+
+func (s *openaiChatStream) Close() error {
+	return s.stream.Close()
+}
+
+// AnthropicClient holds the connection settings for an endpoint implementing
+// the Anthropic messages API.
+type AnthropicClient struct {
+	BaseURL    string
+	APIKey     string
+	HTTPClient *http.Client
+}
+
+// AnthropicProvider streams completions from the Anthropic messages API.
+type AnthropicProvider struct {
+	client *AnthropicClient
+	model  string
+}
+
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	MaxTokens   int                `json:"max_tokens"`
+	Temperature *float32           `json:"temperature,omitempty"`
+	Stream      bool               `json:"stream"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *AnthropicProvider) Name() string {
+	return ANTHROPIC_PROVIDER
+}
+
+func (p *AnthropicProvider) Model() string {
+	return p.model
+}
+
+// toAnthropicMessages splits off the system prompt and merges consecutive
+// messages from the same role, since the messages API requires alternating
+// user and assistant turns.
+func toAnthropicMessages(messages []openai.ChatCompletionMessage) (string, []anthropicMessage) {
+	var system string
+	var out []anthropicMessage
+	for _, msg := range messages {
+		if msg.Role == openai.ChatMessageRoleSystem {
+			system = msg.Content
+			continue
+		}
+		if len(out) > 0 && out[len(out)-1].Role == msg.Role {
+			out[len(out)-1].Content += "\n\n" + msg.Content
+			continue
+		}
+		out = append(out, anthropicMessage{Role: msg.Role, Content: msg.Content})
+	}
+	return system, out
+}
+
+func (p *AnthropicProvider) CreateChatStream(ctx context.Context, req ChatRequest) (ChatStream, error) {
+	system, messages := toAnthropicMessages(req.Messages)
+	maxTokens := req.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = DEFAULT_ANTHROPIC_MAX_TOKENS
+	}
+	data, err := json.Marshal(anthropicRequest{
+		Model:       p.model,
+		System:      system,
+		Messages:    messages,
+		MaxTokens:   maxTokens,
+		Temperature: req.Temperature,
+		Stream:      true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal anthropic request: %v", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", p.client.BaseURL+"/v1/messages", bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create anthropic request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", p.client.APIKey)
+	httpReq.Header.Set("anthropic-version", ANTHROPIC_VERSION)
+
+	res, err := p.client.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("anthropic request failed: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("anthropic request failed with status %d: %s", res.StatusCode, body)
+	}
+	return &anthropicChatStream{body: res.Body, scanner: bufio.NewScanner(res.Body)}, nil
+}
+
+type anthropicChatStream struct {
+	body       io.ReadCloser
+	scanner    *bufio.Scanner
+	usage      Usage
+	stopReason string
+}
+
+func (s *anthropicChatStream) Recv() (string, error) {
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		var event anthropicEvent
+		err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event)
+		if err != nil {
+			return "", fmt.Errorf("unable to decode anthropic event: %v", err)
+		}
+		switch event.Type {
+		case "message_start":
+			s.usage.PromptTokens = event.Message.Usage.InputTokens
+		case "content_block_delta":
+			if event.Delta.Type == "text_delta" {
+				return event.Delta.Text, nil
+			}
+		case "message_delta":
+			s.usage.CompletionTokens = event.Usage.OutputTokens
+			s.stopReason = event.Delta.StopReason
+		case "message_stop":
+			return "", io.EOF
+		case "error":
+			return "", fmt.Errorf("anthropic stream error %s: %s", event.Error.Type, event.Error.Message)
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", io.EOF
+}
+
+func (s *anthropicChatStream) Usage() Usage {
+	return s.usage
+}
+
+func (s *anthropicChatStream) FinishReason() string {
+	return s.stopReason
+}
+
+func (s *anthropicChatStream) Close() error {
+	return s.body.Close()
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Waves of questions. The pre wave is asked before the chat and the post
+// wave after it, so questions asked in both measure attitude change.
+const (
+	WAVE_PRE  = "pre"
+	WAVE_POST = "post"
+)
+
+// Question types. The comment of each type says how its answer is stored in
+// response_answer.value.
+const (
+	// QUESTION_SINGLE_CHOICE stores the value of the selected option.
+	QUESTION_SINGLE_CHOICE = "single_choice"
+	// QUESTION_LIKERT is a grid that rates every item on the scale in
+	// Options. It stores a JSON object from item value to option value.
+	QUESTION_LIKERT = "likert"
+	// QUESTION_SLIDER picks a number between Min and Max, 0 to 100 unless
+	// set, such as a feeling thermometer. Options label the scale. It
+	// stores the number, and is not answered until the slider is moved.
+	QUESTION_SLIDER = "slider"
+	// QUESTION_RANKING orders the options. It stores a JSON array of option
+	// values from first to last.
+	QUESTION_RANKING = "ranking"
+	// QUESTION_TEXT is an open answer. It stores the text.
+	QUESTION_TEXT = "text"
+)
+
+// QUESTIONNAIRE_FILE is the questionnaire used by surveys deployed without
+// one.
+const QUESTIONNAIRE_FILE = "questionnaire.json"
+
+var defaultQuestionnaire Questionnaire
+
+// Question IDs are form field names and response_answer keys.
+var questionIDPattern = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+var (
+	answerQueryStmt  *sql.Stmt
+	answerUpsertStmt *sql.Stmt
+	answerDeleteStmt *sql.Stmt
+)
+
+type Option struct {
+	Value string `json:"value"`
+	Label string `json:"label"`
+	// Anchor keeps the option in place when the options are randomized,
+	// such as "Not sure" at the end.
+	Anchor bool `json:"anchor,omitempty"`
+	// ScreenOut ends the response as a screen-out when the option is
+	// selected.
+	ScreenOut bool `json:"screen_out,omitempty"`
+}
+
+// Detail is a titled paragraph shown between a question and its options.
+type Detail struct {
+	Heading string `json:"heading,omitempty"`
+	Text    string `json:"text"`
+}
+
+type Question struct {
+	ID      string   `json:"id"`
+	Text    string   `json:"text"`
+	Details []Detail `json:"details,omitempty"`
+	Type    string   `json:"type"`
+	Options []Option `json:"options,omitempty"`
+	// Items are the rows of a likert grid.
+	Items    []Option `json:"items,omitempty"`
+	Required bool     `json:"required,omitempty"`
+	// Randomize shows the options, or the items of a likert grid, in a
+	// random order for every response.
+	Randomize bool `json:"randomize,omitempty"`
+	// Min and Max bound slider answers.
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	// Step is the slider increment. It defaults to 1.
+	Step float64 `json:"step,omitempty"`
+	// MinLength and MaxLength bound the number of characters of a text answer.
+	MinLength int `json:"min_length,omitempty"`
+	MaxLength int `json:"max_length,omitempty"`
+	// ShowIf limits the question to some responses.
+	ShowIf *Condition `json:"show_if,omitempty"`
+	// Expect makes the question an attention check passed by these option
+	// values. Any other answer ends the response as a quality termination.
+	Expect []string `json:"expect,omitempty"`
+}
+
+type Page struct {
+	Questions []Question `json:"questions"`
+	// Randomize shows the questions in a random order for every response.
+	Randomize bool `json:"randomize,omitempty"`
+	// ShowIf limits the page to some responses.
+	ShowIf *Condition `json:"show_if,omitempty"`
+}
+
+// Questionnaire defines the pages of both waves of a survey.
+type Questionnaire struct {
+	Pre  []Page `json:"pre"`
+	Post []Page `json:"post"`
+}
+
+// Pages returns the pages of wave.
+func (q Questionnaire) Pages(wave string) []Page {
+	if wave == WAVE_PRE {
+		return q.Pre
+	}
+	return q.Post
+}
+
+// Question finds the question with id in wave.
+func (q Questionnaire) Question(wave string, id string) (Question, bool) {
+	for _, page := range q.Pages(wave) {
+		for _, question := range page.Questions {
+			if question.ID == id {
+				return question, true
+			}
+		}
+	}
+	return Question{}, false
+}
+
+func (q Questionnaire) Validate() error {
+	for _, wave := range []string{WAVE_PRE, WAVE_POST} {
+		pages := q.Pages(wave)
+		if len(pages) == 0 {
+			return fmt.Errorf("the %s wave needs at least one page", wave)
+		}
+		ids := map[string]bool{}
+		for i, page := range pages {
+			if len(page.Questions) == 0 {
+				return fmt.Errorf("%s page %d has no questions", wave, i+1)
+			}
+			for _, question := range page.Questions {
+				if !questionIDPattern.MatchString(question.ID) || ids[question.ID] {
+					return fmt.Errorf("%s wave has an invalid or duplicate question id %q", wave, question.ID)
+				}
+				ids[question.ID] = true
+				if err := question.validate(); err != nil {
+					return fmt.Errorf("%s question %s: %v", wave, question.ID, err)
+				}
+			}
+		}
+		if err := q.validateBranching(wave); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q Question) validate() error {
+	if q.Text == "" {
+		return errors.New("text is required")
+	}
+	switch q.Type {
+	case QUESTION_SINGLE_CHOICE:
+		if len(q.Options) < 2 {
+			return errors.New("a single choice question needs at least two options")
+		}
+		if err := validateOptions(q.Options, false); err != nil {
+			return err
+		}
+	case QUESTION_LIKERT:
+		if len(q.Items) == 0 || len(q.Options) < 2 {
+			return errors.New("a likert question needs items and at least two options")
+		}
+		if err := validateOptions(q.Items, true); err != nil {
+			return err
+		}
+		if err := validateOptions(q.Options, false); err != nil {
+			return err
+		}
+	case QUESTION_SLIDER:
+		if q.Step < 0 {
+			return fmt.Errorf("invalid step %g", q.Step)
+		}
+		min, max := q.sliderBounds()
+		if min >= max {
+			return fmt.Errorf("slider min %g is not less than max %g", min, max)
+		}
+		if q.sliderStep() > max-min {
+			return fmt.Errorf("step %g is larger than the slider range", q.Step)
+		}
+	case QUESTION_RANKING:
+		if len(q.Options) < 2 {
+			return errors.New("a ranking question needs at least two options")
+		}
+		if err := validateOptions(q.Options, true); err != nil {
+			return err
+		}
+	case QUESTION_TEXT:
+	default:
+		return fmt.Errorf("unknown question type %q", q.Type)
+	}
+	if err := q.validateExits(); err != nil {
+		return err
+	}
+	if q.Randomize && q.presentedOrder() == nil {
+		return fmt.Errorf("%s questions cannot randomize their options", q.Type)
+	}
+	if q.Min != nil && q.Max != nil && *q.Min > *q.Max {
+		return fmt.Errorf("min %g is greater than max %g", *q.Min, *q.Max)
+	}
+	if q.MinLength < 0 || q.MaxLength < 0 || (q.MaxLength > 0 && q.MinLength > q.MaxLength) {
+		return fmt.Errorf("invalid length bounds %d to %d", q.MinLength, q.MaxLength)
+	}
+	return nil
+}
+
+// validateOptions checks option values are unique. Values that end up in
+// form field names and export columns must also be valid question IDs.
+func validateOptions(options []Option, fieldNames bool) error {
+	values := map[string]bool{}
+	for _, option := range options {
+		if option.Value == "" || values[option.Value] {
+			return fmt.Errorf("invalid or duplicate option value %q", option.Value)
+		}
+		if fieldNames && !questionIDPattern.MatchString(option.Value) {
+			return fmt.Errorf("invalid option value %q", option.Value)
+		}
+		values[option.Value] = true
+	}
+	return nil
+}
+
+// sliderBounds returns the range of a slider.
+func (q Question) sliderBounds() (float64, float64) {
+	min, max := 0.0, 100.0
+	if q.Min != nil {
+		min = *q.Min
+	}
+	if q.Max != nil {
+		max = *q.Max
+	}
+	return min, max
+}
+
+func (q Question) sliderStep() float64 {
+	if q.Step == 0 {
+		return 1
+	}
+	return q.Step
+}
+
+// loadQuestionnaire reads the questionnaire in file.
+func loadQuestionnaire(file string) (Questionnaire, error) {
+	var q Questionnaire
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return q, fmt.Errorf("unable to read questionnaire: %v", err)
+	}
+	if err := json.Unmarshal(content, &q); err != nil {
+		return q, fmt.Errorf("invalid questionnaire in %s: %v", file, err)
+	}
+	return q, q.Validate()
+}
+
+// parseQuestionnaire decodes the questionnaire JSON object sent to /deploy.
+// An empty parameter uses the default questionnaire.
+func parseQuestionnaire(param string) (Questionnaire, error) {
+	if param == "" {
+		return defaultQuestionnaire, nil
+	}
+	var q Questionnaire
+	if err := json.Unmarshal([]byte(param), &q); err != nil {
+		return q, fmt.Errorf("invalid questionnaire: %v", err)
+	}
+	return q, q.Validate()
+}
+
+// SurveyResponse is a response and its answers to one wave.
+type SurveyResponse struct {
+	ID              *uuid.UUID
+	SurveyID        *uuid.UUID
+	ResponseID      string
+	StartTime       *time.Time
+	PreCompleteTime *time.Time
+	// Seed orders randomized questions and options.
+	Seed int64
+	// Condition is the experiment condition the response is assigned to.
+	Condition string
+	// ExitStatus is set once the response has ended, see EXIT_COMPLETE.
+	ExitStatus string
+	// Answers maps question IDs to answers in the wave loaded.
+	Answers map[string]string
+	// Waves holds the answers of every wave, which show_if conditions
+	// can refer to.
+	Waves map[string]map[string]string
+}
+
+func (sq *SurveyResponse) Scan(row *sql.Row) error {
+	return row.Scan(
+		&sq.ID,
+		&sq.SurveyID,
+		&sq.ResponseID,
+		&sq.StartTime,
+		&sq.PreCompleteTime,
+		&sq.Seed,
+		&sq.Condition,
+		&sq.ExitStatus,
+	)
+}
+
+// LoadAnswers reads the answers given so far. Answers holds those to wave.
+func (sq *SurveyResponse) LoadAnswers(wave string) error {
+	sq.Answers = map[string]string{}
+	sq.Waves = map[string]map[string]string{wave: sq.Answers}
+	rows, err := answerQueryStmt.Query(sq.ID)
+	if err != nil {
+		return fmt.Errorf("failed to execute answerQueryStmt: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var answerWave, questionID, value string
+		if err := rows.Scan(&answerWave, &questionID, &value); err != nil {
+			return err
+		}
+		if sq.Waves[answerWave] == nil {
+			sq.Waves[answerWave] = map[string]string{}
+		}
+		sq.Waves[answerWave][questionID] = value
+	}
+	return rows.Err()
+}
+
+// Update stores the answers to page, which must have been checked by
+// pageAnswers. page is the page as presented, so the position of each
+// question and the order of its options are stored with the answer. Answers
+// to questions of pages that the new answers hide are deleted.
+func (sq *SurveyResponse) Update(wave string, pages []Page, page Page, answers map[string]string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for i, question := range page.Questions {
+		value, ok := answers[question.ID]
+		if !ok {
+			continue
+		}
+		_, err := tx.Stmt(answerUpsertStmt).Exec(sq.ID, wave, question.ID, value, i+1, pq.Array(question.presentedOrder()))
+		if err != nil {
+			return fmt.Errorf("error executing answerUpsertStmt: %v", err)
+		}
+		sq.Answers[question.ID] = value
+	}
+	if hidden := sq.hiddenAnswers(wave, pages); len(hidden) > 0 {
+		_, err := tx.Stmt(answerDeleteStmt).Exec(sq.ID, wave, pq.Array(hidden))
+		if err != nil {
+			return fmt.Errorf("error executing answerDeleteStmt: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// presentPage returns page index of wave as shown to sq, with the questions
+// it hides left out and randomized questions and options in the order drawn
+// from the response seed.
+func (sq SurveyResponse) presentPage(wave string, index int, page Page) Page {
+	presented := Page{Questions: slices.Clone(page.Questions)}
+	if page.Randomize {
+		purpose := fmt.Sprintf("%s-%s-%d", PURPOSE_QUESTION_ORDER, wave, index+1)
+		presented.Questions = shuffled(page.Questions, sq.Seed, *sq.ID, purpose)
+	}
+	// Questions are hidden after the shuffle so their order does not
+	// depend on which are shown.
+	shown := sq.shownQuestions(wave, page)
+	presented.Questions = slices.DeleteFunc(presented.Questions, func(q Question) bool {
+		return !slices.ContainsFunc(shown, func(s Question) bool { return s.ID == q.ID })
+	})
+	for i, question := range presented.Questions {
+		if !question.Randomize {
+			continue
+		}
+		purpose := fmt.Sprintf("%s-%s-%s", PURPOSE_OPTION_ORDER, wave, question.ID)
+		if question.Type == QUESTION_LIKERT {
+			presented.Questions[i].Items = shuffledOptions(question.Items, sq.Seed, *sq.ID, purpose)
+		} else {
+			presented.Questions[i].Options = shuffledOptions(question.Options, sq.Seed, *sq.ID, purpose)
+		}
+	}
+	return presented
+}
+
+// shuffledOptions shuffles the options that are not anchored among their
+// positions.
+func shuffledOptions(options []Option, seed int64, responseID uuid.UUID, purpose string) []Option {
+	var free []Option
+	for _, option := range options {
+		if !option.Anchor {
+			free = append(free, option)
+		}
+	}
+	free = shuffled(free, seed, responseID, purpose)
+	order := slices.Clone(options)
+	for i, option := range order {
+		if !option.Anchor {
+			order[i], free = free[0], free[1:]
+		}
+	}
+	return order
+}
+
+// presentedOrder returns the values of the options, or the items of a likert
+// grid, in the order shown. Sliders and text have no order.
+func (q Question) presentedOrder() []string {
+	options := q.Options
+	switch q.Type {
+	case QUESTION_LIKERT:
+		options = q.Items
+	case QUESTION_SLIDER, QUESTION_TEXT:
+		return nil
+	}
+	order := make([]string, len(options))
+	for i, option := range options {
+		order[i] = option.Value
+	}
+	return order
+}
+
+// QuestionView is a question as rendered on a page.
+type QuestionView struct {
+	Question
+	Number int
+	Value  string
+	// Error explains why the submitted answer was not accepted.
+	Error string
+	// Grid and Ranks decode the answers to likert and ranking questions.
+	Grid  map[string]string
+	Ranks map[string]int
+	// Positions are the ranks a ranking option can be given.
+	Positions []int
+	// SliderMin, SliderMax and SliderStep configure the slider input.
+	SliderMin  float64
+	SliderMax  float64
+	SliderStep float64
+}
+
+// SurveyPage is the data for the survey-page template.
+type SurveyPage struct {
+	ResponseID uuid.UUID
+	// Action is the handler the page is posted to.
+	Action string
+	Page   int
+	// First and Last mark the ends of the pages shown to the response.
+	First     bool
+	Last      bool
+	Questions []QuestionView
+}
+
+// newSurveyPage numbers the questions of page among those shown to sq and
+// fills in the answers given so far. page starts at 1. invalid holds
+// rejected answers, which are shown again with their error so they can be
+// corrected.
+func newSurveyPage(sq SurveyResponse, wave string, pages []Page, page int, invalid map[string]AnswerError) SurveyPage {
+	path := sq.path(wave, pages)
+	sp := SurveyPage{
+		ResponseID: *sq.ID,
+		Action:     "/survey",
+		Page:       page,
+		First:      len(path) == 0 || path[0] == page-1,
+		Last:       sq.lastPage(wave, pages, page-1),
+	}
+	if wave == WAVE_PRE {
+		sp.Action = "/pre-survey"
+	}
+	number := 1
+	for _, i := range path {
+		if i >= page-1 {
+			break
+		}
+		number += len(sq.shownQuestions(wave, pages[i]))
+	}
+	for i, question := range sq.presentPage(wave, page-1, pages[page-1]).Questions {
+		view := QuestionView{
+			Question: question,
+			Number:   number + i,
+			Value:    sq.Answers[question.ID],
+		}
+		if answerErr, ok := invalid[question.ID]; ok {
+			view.Value = answerErr.Value
+			view.Error = answerErr.Message
+		}
+		view.decode()
+		sp.Questions = append(sp.Questions, view)
+	}
+	return sp
+}
+
+// decode fills in the fields the templates of each question type need.
+func (view *QuestionView) decode() {
+	switch view.Type {
+	case QUESTION_LIKERT:
+		view.Grid = decodeGrid(view.Value)
+	case QUESTION_RANKING:
+		view.Ranks = map[string]int{}
+		for i, value := range decodeRanking(view.Value) {
+			view.Ranks[value] = i + 1
+		}
+		for i := range view.Options {
+			view.Positions = append(view.Positions, i+1)
+		}
+	case QUESTION_SLIDER:
+		view.SliderMin, view.SliderMax = view.sliderBounds()
+		view.SliderStep = view.sliderStep()
+	}
+}
+
+// decodeGrid decodes a likert answer. Invalid answers decode as empty.
+func decodeGrid(value string) map[string]string {
+	grid := map[string]string{}
+	if value != "" {
+		json.Unmarshal([]byte(value), &grid)
+	}
+	return grid
+}
+
+// decodeRanking decodes a ranking answer. Invalid answers decode as empty.
+func decodeRanking(value string) []string {
+	var ranking []string
+	if value != "" {
+		json.Unmarshal([]byte(value), &ranking)
+	}
+	return ranking
+}
+
+// responseQuestionnaire returns the questionnaire of the survey sq belongs to.
+func responseQuestionnaire(sq SurveyResponse) (Questionnaire, error) {
+	if sq.SurveyID == nil {
+		return defaultQuestionnaire, nil
+	}
+	var surveyConfig SurveyConfig
+	err := surveyConfig.Scan(surveyConfigQueryStmt.QueryRow(sq.SurveyID))
+	if err != nil {
+		return Questionnaire{}, fmt.Errorf("failed to get survey config: %v", err)
+	}
+	return surveyConfig.Questionnaire, nil
+}
+
+// serveWave shows and saves the pages of wave for the response in the
+// response-id parameter. finish is called once the last page is answered.
+// Responses that have exited are sent back to their exit, and answers that
+// fail an attention check or screen out end the response.
+func serveWave(w http.ResponseWriter, r *http.Request, wave string, finish func(http.ResponseWriter, *http.Request, SurveyResponse)) {
+	ID, err := uuid.Parse(r.URL.Query().Get("response-id"))
+	if err != nil {
+		log.Printf("unable to parse reponse id %s: %v\n", r.URL.Query().Get("response-id"), err)
+		http.Error(w, "invalid response-id", http.StatusBadRequest)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		log.Printf("error parsing form: %v\n", err)
+	}
+	navigate := r.FormValue("navigate")
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil {
+		log.Printf("unable to convert page %s: %v", r.FormValue("page"), err)
+		http.Error(w, "expected page parameter as an int", http.StatusBadRequest)
+		return
+	}
+	var survey SurveyResponse
+	err = survey.Scan(responseQueryStmt.QueryRow(ID))
+	if err != nil {
+		log.Printf("error scanning survey response: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if survey.ExitStatus != "" {
+		exitSurvey(w, r, survey, survey.ExitStatus)
+		return
+	}
+	// Pre-survey answers cannot change once the chat has started, and the
+	// post-survey stays closed until the pre-survey is complete.
+	if wave == WAVE_PRE && survey.PreCompleteTime != nil || wave == WAVE_POST && survey.PreCompleteTime == nil {
+		w.Header().Set("HX-Redirect", "/debate?response-id="+ID.String())
+		return
+	}
+	err = survey.LoadAnswers(wave)
+	if err != nil {
+		log.Printf("unable to load answers: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	questionnaire, err := responseQuestionnaire(survey)
+	if err != nil {
+		log.Printf("%v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	pages := questionnaire.Pages(wave)
+	if page < 1 || page > len(pages) || !slices.Contains(survey.path(wave, pages), page-1) {
+		http.Error(w, "page out of range", http.StatusBadRequest)
+		return
+	}
+
+	var invalid map[string]AnswerError
+	if r.Method == "POST" {
+		// Only valid answers are stored. Going back does not require the
+		// page to be complete, but going forward does.
+		presented := survey.presentPage(wave, page-1, pages[page-1])
+		var answers map[string]string
+		answers, invalid = pageAnswers(presented, r.PostForm, survey.Answers)
+		err = survey.Update(wave, pages, presented, answers)
+		if err != nil {
+			log.Printf("failed to update survey: %v\n", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if navigate == "next" && len(invalid) == 0 {
+			if status := presented.exitStatus(answers); status != "" {
+				exitSurvey(w, r, survey, status)
+				return
+			}
+		}
+
+		// The answers may have changed which of the later pages are
+		// shown. Earlier pages only depend on answers before them, so
+		// previous returns to the page the respondent came from.
+		path := survey.path(wave, pages)
+		position := slices.Index(path, page-1)
+		if navigate == "next" && len(invalid) == 0 {
+			position += 1
+		} else if navigate == "previous" && position > 0 {
+			position -= 1
+			invalid = nil
+		}
+		if position == len(path) {
+			finish(w, r, survey)
+			return
+		}
+		page = path[position] + 1
+	}
+	err = tmpls.ExecuteTemplate(w, "survey-page", newSurveyPage(survey, wave, pages, page, invalid))
+	if err != nil {
+		log.Printf("error executing template survey-page: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
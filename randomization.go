@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+var (
+	blockInitStmt   *sql.Stmt
+	blockQueryStmt  *sql.Stmt
+	blockUpdateStmt *sql.Stmt
+	balanceStmt     *sql.Stmt
+	completeStmt    *sql.Stmt
+)
+
+// BlockSlot is a position in the permuted blocks of a survey stratum.
+type BlockSlot struct {
+	Number int
+	Index  int
+}
+
+// lockBlock locks the block row of surveyID and stratum until tx ends and
+// returns the slot it points at, creating the row if needed.
+func lockBlock(tx *sql.Tx, surveyID uuid.UUID, stratum string) (BlockSlot, error) {
+	var slot BlockSlot
+	_, err := tx.Stmt(blockInitStmt).Exec(surveyID, stratum)
+	if err != nil {
+		return slot, fmt.Errorf("failed to execute blockInitStmt: %v", err)
+	}
+	err = tx.Stmt(blockQueryStmt).QueryRow(surveyID, stratum).Scan(&slot.Number, &slot.Index)
+	if err != nil {
+		return slot, fmt.Errorf("failed to execute blockQueryStmt: %v", err)
+	}
+	return slot, nil
+}
+
+// nextBlockSlot takes the next slot of the current block of surveyID and
+// stratum, starting a new block once it is used up. The block row is locked
+// until tx ends, so concurrent entries get consecutive slots.
+func nextBlockSlot(tx *sql.Tx, surveyID uuid.UUID, stratum string, blockSize int) (BlockSlot, error) {
+	slot, err := lockBlock(tx, surveyID, stratum)
+	if err != nil {
+		return slot, err
+	}
+	if slot.Index >= blockSize {
+		slot.Number++
+		slot.Index = 0
+	}
+	_, err = tx.Stmt(blockUpdateStmt).Exec(surveyID, stratum, slot.Number, slot.Index+1)
+	if err != nil {
+		return slot, fmt.Errorf("failed to execute blockUpdateStmt: %v", err)
+	}
+	return slot, nil
+}
+
+// permutedBlock returns every cell blockSize/cells times, in the order drawn
+// from seed for block number of stratum.
+func permutedBlock(seed int64, stratum string, number int, cells int, blockSize int) []int {
+	block := make([]int, blockSize)
+	for i := range block {
+		block[i] = i % cells
+	}
+	r := seededRand(seed, PURPOSE_BLOCK, stratum, strconv.Itoa(number))
+	r.Shuffle(len(block), func(i, j int) {
+		block[i], block[j] = block[j], block[i]
+	})
+	return block
+}
+
+// ArmCount is the number of responses assigned to a cell that started and
+// completed the survey. Participants turned away over quota are never
+// assigned and are not counted.
+type ArmCount struct {
+	Cell      string `json:"cell"`
+	Stratum   string `json:"stratum,omitempty"`
+	Started   int    `json:"started"`
+	Completed int    `json:"completed"`
+}
+
+type BalanceReport struct {
+	SurveyID  uuid.UUID `json:"survey_id"`
+	Method    string    `json:"method"`
+	Started   int       `json:"started"`
+	Completed int       `json:"completed"`
+	// Arms has a count for every cell of the design, including cells nobody
+	// has been assigned to yet.
+	Arms []ArmCount `json:"arms"`
+	// Strata breaks the arms down by stratum for stratified designs.
+	Strata []ArmCount `json:"strata,omitempty"`
+}
+
+func balanceReport(surveyID uuid.UUID) (*BalanceReport, error) {
+	var config SurveyConfig
+	err := config.Scan(surveyConfigQueryStmt.QueryRow(surveyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get survey config: %v", err)
+	}
+	report := &BalanceReport{
+		SurveyID: surveyID,
+		Method:   config.Design.Method,
+		Arms:     []ArmCount{},
+	}
+	arms := map[string]int{}
+	for i := range config.Design.CellCount() {
+		cell := config.Design.CellName(config.Design.Cell(i))
+		arms[cell] = len(report.Arms)
+		report.Arms = append(report.Arms, ArmCount{Cell: cell})
+	}
+
+	rows, err := balanceStmt.Query(surveyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute balanceStmt: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var count ArmCount
+		if err := rows.Scan(&count.Cell, &count.Stratum, &count.Started, &count.Completed); err != nil {
+			return nil, err
+		}
+		report.Started += count.Started
+		report.Completed += count.Completed
+		if config.Design.Method == ASSIGN_STRATIFIED {
+			report.Strata = append(report.Strata, count)
+		}
+		i, ok := arms[count.Cell]
+		if !ok {
+			// Responses from before the survey had a design.
+			i = len(report.Arms)
+			arms[count.Cell] = i
+			report.Arms = append(report.Arms, ArmCount{Cell: count.Cell})
+		}
+		report.Arms[i].Started += count.Started
+		report.Arms[i].Completed += count.Completed
+	}
+	return report, rows.Err()
+}
+
+func handleBalance(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != os.Getenv("LUCIDHQ_API_KEY") {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	surveyID, err := uuid.Parse(r.URL.Query().Get("survey-id"))
+	if err != nil {
+		log.Printf("unable to parse survey-id %s: %v\n", r.URL.Query().Get("survey-id"), err)
+		http.Error(w, "invalid survey-id parameter", http.StatusBadRequest)
+		return
+	}
+	report, err := balanceReport(surveyID)
+	if err != nil {
+		log.Printf("failed to report balance: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Printf("unable to encode balance report: %v\n", err)
+	}
+}
@@ -1,18 +1,46 @@
+-- This file creates the database and upgrades databases created by an
+-- earlier version of it, so it can be run again on every deploy.
+
 -- Enable UUID extension
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
 
+-- Create the prompt version table
+CREATE TABLE IF NOT EXISTS prompt_version (
+  id TEXT PRIMARY KEY,
+  name TEXT NOT NULL,
+  content TEXT NOT NULL,
+  create_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+
 -- Create the survey table
-CREATE TABLE survey (
+CREATE TABLE IF NOT EXISTS survey (
   id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
   lucid_id INT UNIQUE,
   chat_time INT,
+  provider TEXT DEFAULT 'openai',
+  model_parity TEXT DEFAULT 'shared',
+  model TEXT,
+  temperature REAL,
+  reasoning_effort TEXT,
+  max_tokens INT,
+  stream BOOLEAN,
+  bot_settings JSONB DEFAULT '{}',
+  prompt_versions JSONB DEFAULT '{}',
+  topics JSONB,
+  personas JSONB,
+  conditions JSONB,
+  design JSONB,
+  seed BIGINT,
+  questionnaire JSONB,
+  targeting JSONB,
   create_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
 
 -- Create the response table
-CREATE TABLE response (
+CREATE TABLE IF NOT EXISTS response (
   id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
   survey_id UUID REFERENCES survey(id) ON UPDATE RESTRICT ON DELETE RESTRICT,
   response_id TEXT DEFAULT '',
@@ -24,27 +52,253 @@ CREATE TABLE response (
   hispanic TEXT DEFAULT '',
   ethnicity TEXT DEFAULT '',
   standard_vote TEXT DEFAULT '',
+  -- The answer columns below are only set on responses recorded before
+  -- answers moved to response_answer.
   which_llm TEXT DEFAULT '',
   ai_speed TEXT DEFAULT '',
+  power_x_bad_actor TEXT DEFAULT '',
+  ai_regulation_approach TEXT DEFAULT '',
+  ban_x_no_regulation TEXT DEFAULT '',
+  ban_x_mandates TEXT DEFAULT '',
+  mandates_x_no_regulation TEXT DEFAULT '',
   musk_opinion TEXT DEFAULT '',
   patterson_opinion TEXT DEFAULT '',
   kensington_opinion TEXT DEFAULT '',
   potholes TEXT DEFAULT '',
+  pre_ai_speed TEXT DEFAULT '',
+  pre_ai_regulation_approach TEXT DEFAULT '',
+  -- The chat starts once the pre-survey is complete.
+  pre_complete_time TIMESTAMP WITH TIME ZONE,
   start_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
   completed BOOLEAN DEFAULT TRUE,
-  innovate_first BOOLEAN DEFAULT FALSE
+  innovate_first BOOLEAN DEFAULT FALSE,
+  condition TEXT DEFAULT 'debate',
+  assignment JSONB,
+  cell TEXT,
+  stratum TEXT,
+  complete_time TIMESTAMP WITH TIME ZONE,
+  -- How the response ended: complete, terminate, over_quota or quality.
+  -- Only the first exit is kept.
+  exit_status TEXT,
+  exit_time TIMESTAMP WITH TIME ZONE,
+  seed BIGINT,
+  block_number INT,
+  block_index INT
 );
 
 -- Create the chat table
-CREATE TABLE chat (
+CREATE TABLE IF NOT EXISTS chat (
   id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
   response_id UUID REFERENCES response(id) ON UPDATE RESTRICT ON DELETE RESTRICT,
   user_msg TEXT NOT NULL,
+  -- The per bot columns below are only set on chats recorded before bot
+  -- messages moved to chat_message.
   safety_msg TEXT DEFAULT '',
   innovation_msg TEXT DEFAULT '',
+  safety_settings JSONB,
+  innovation_settings JSONB,
+  safety_meta JSONB,
+  innovation_meta JSONB,
+  safety_prompt_version TEXT REFERENCES prompt_version(id),
+  innovation_prompt_version TEXT REFERENCES prompt_version(id),
   created_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
+-- One row per bot reply to a chat question
+CREATE TABLE IF NOT EXISTS chat_message (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  chat_id UUID REFERENCES chat(id) ON UPDATE RESTRICT ON DELETE RESTRICT,
+  response_id UUID REFERENCES response(id) ON UPDATE RESTRICT ON DELETE RESTRICT,
+  persona TEXT NOT NULL,
+  position INT NOT NULL,
+  content TEXT DEFAULT '',
+  prompt_version TEXT REFERENCES prompt_version(id),
+  settings JSONB,
+  meta JSONB,
+  created_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (chat_id, position)
+);
+
+-- One row per answer to a questionnaire question. wave is 'pre' for the
+-- questions asked before the chat and 'post' for those asked after it.
+-- position is the place of the question on its page and presented_order the
+-- option values, or likert items, in the order they were shown. Both are
+-- NULL for answers copied from the legacy columns.
+CREATE TABLE IF NOT EXISTS response_answer (
+  response_id UUID REFERENCES response(id) ON UPDATE RESTRICT ON DELETE RESTRICT,
+  wave TEXT NOT NULL,
+  question_id TEXT NOT NULL,
+  value TEXT NOT NULL DEFAULT '',
+  position INTEGER,
+  presented_order TEXT[],
+  update_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (response_id, wave, question_id)
+);
+
+-- The quota cells a survey was deployed with. question is the Lucid
+-- standard question, such as STANDARD_VOTE, and precodes the answers in the
+-- cell. Fill is counted from the matching demographic column of response.
+CREATE TABLE IF NOT EXISTS survey_quota (
+  survey_id UUID REFERENCES survey(id) ON UPDATE RESTRICT ON DELETE RESTRICT,
+  question TEXT NOT NULL,
+  cell TEXT NOT NULL,
+  precodes TEXT[] NOT NULL,
+  quota INT NOT NULL,
+  lucid_quota_id INT,
+  position INT NOT NULL,
+  PRIMARY KEY (survey_id, question, cell)
+);
+
+-- The history of the Lucid survey of a survey: the deploy and every later
+-- pause, resume, close, quantity or cpi change. Only the fields an action
+-- changes are set. error is set when Lucid rejected the change.
+CREATE TABLE IF NOT EXISTS survey_status (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  survey_id UUID REFERENCES survey(id) ON UPDATE RESTRICT ON DELETE RESTRICT,
+  action TEXT NOT NULL,
+  status TEXT,
+  quantity INT,
+  cpi REAL,
+  error TEXT,
+  create_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- The current permuted block of every survey and stratum. The order of the
+-- cells in a block is derived from the survey seed, so only the position
+-- is stored. Thompson designs only lock their row to allocate one response
+-- at a time.
+CREATE TABLE IF NOT EXISTS randomization_block (
+  survey_id UUID REFERENCES survey(id) ON UPDATE RESTRICT ON DELETE RESTRICT,
+  stratum TEXT NOT NULL DEFAULT '',
+  block_number INT NOT NULL DEFAULT 0,
+  next_index INT NOT NULL DEFAULT 0,
+  update_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (survey_id, stratum)
+);
+
+-- The probabilities every response of a thompson design was allocated with.
+-- arms holds the successes, failures and probability of every cell at the
+-- time, so the analysis can weight responses by inverse probability.
+CREATE TABLE IF NOT EXISTS allocation_log (
+  id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+  survey_id UUID REFERENCES survey(id) ON UPDATE RESTRICT ON DELETE RESTRICT,
+  response_id UUID UNIQUE REFERENCES response(id) ON UPDATE RESTRICT ON DELETE RESTRICT,
+  cell TEXT NOT NULL,
+  probability DOUBLE PRECISION NOT NULL,
+  burn_in BOOLEAN NOT NULL,
+  arms JSONB NOT NULL,
+  create_time TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Upgrade databases created by an earlier version of this file. The
+-- tables that already exist are left as they are, so the columns added to
+-- them since are added here.
+ALTER TABLE survey
+  ADD COLUMN IF NOT EXISTS provider TEXT DEFAULT 'openai',
+  ADD COLUMN IF NOT EXISTS model_parity TEXT DEFAULT 'position',
+  ADD COLUMN IF NOT EXISTS model TEXT,
+  ADD COLUMN IF NOT EXISTS temperature REAL,
+  ADD COLUMN IF NOT EXISTS reasoning_effort TEXT,
+  ADD COLUMN IF NOT EXISTS max_tokens INT,
+  ADD COLUMN IF NOT EXISTS stream BOOLEAN,
+  ADD COLUMN IF NOT EXISTS bot_settings JSONB DEFAULT '{}',
+  ADD COLUMN IF NOT EXISTS prompt_versions JSONB DEFAULT '{}',
+  ADD COLUMN IF NOT EXISTS topics JSONB,
+  ADD COLUMN IF NOT EXISTS personas JSONB,
+  ADD COLUMN IF NOT EXISTS conditions JSONB,
+  ADD COLUMN IF NOT EXISTS design JSONB,
+  ADD COLUMN IF NOT EXISTS seed BIGINT,
+  ADD COLUMN IF NOT EXISTS questionnaire JSONB,
+  ADD COLUMN IF NOT EXISTS targeting JSONB;
+
+-- Surveys deployed before model_parity existed ran on position parity and
+-- are backfilled with it above. New surveys default to shared parity.
+ALTER TABLE survey ALTER COLUMN model_parity SET DEFAULT 'shared';
+
+ALTER TABLE response
+  ADD COLUMN IF NOT EXISTS which_llm TEXT DEFAULT '',
+  ADD COLUMN IF NOT EXISTS ai_speed TEXT DEFAULT '',
+  ADD COLUMN IF NOT EXISTS power_x_bad_actor TEXT DEFAULT '',
+  ADD COLUMN IF NOT EXISTS ai_regulation_approach TEXT DEFAULT '',
+  ADD COLUMN IF NOT EXISTS ban_x_no_regulation TEXT DEFAULT '',
+  ADD COLUMN IF NOT EXISTS ban_x_mandates TEXT DEFAULT '',
+  ADD COLUMN IF NOT EXISTS mandates_x_no_regulation TEXT DEFAULT '',
+  ADD COLUMN IF NOT EXISTS musk_opinion TEXT DEFAULT '',
+  ADD COLUMN IF NOT EXISTS patterson_opinion TEXT DEFAULT '',
+  ADD COLUMN IF NOT EXISTS kensington_opinion TEXT DEFAULT '',
+  ADD COLUMN IF NOT EXISTS potholes TEXT DEFAULT '',
+  ADD COLUMN IF NOT EXISTS pre_ai_speed TEXT DEFAULT '',
+  ADD COLUMN IF NOT EXISTS pre_ai_regulation_approach TEXT DEFAULT '',
+  ADD COLUMN IF NOT EXISTS pre_complete_time TIMESTAMP WITH TIME ZONE,
+  ADD COLUMN IF NOT EXISTS condition TEXT DEFAULT 'debate',
+  ADD COLUMN IF NOT EXISTS assignment JSONB,
+  ADD COLUMN IF NOT EXISTS cell TEXT,
+  ADD COLUMN IF NOT EXISTS stratum TEXT,
+  ADD COLUMN IF NOT EXISTS complete_time TIMESTAMP WITH TIME ZONE,
+  ADD COLUMN IF NOT EXISTS exit_status TEXT,
+  ADD COLUMN IF NOT EXISTS exit_time TIMESTAMP WITH TIME ZONE,
+  ADD COLUMN IF NOT EXISTS seed BIGINT,
+  ADD COLUMN IF NOT EXISTS block_number INT,
+  ADD COLUMN IF NOT EXISTS block_index INT;
+
+ALTER TABLE chat
+  ADD COLUMN IF NOT EXISTS safety_settings JSONB,
+  ADD COLUMN IF NOT EXISTS innovation_settings JSONB,
+  ADD COLUMN IF NOT EXISTS safety_meta JSONB,
+  ADD COLUMN IF NOT EXISTS innovation_meta JSONB,
+  ADD COLUMN IF NOT EXISTS safety_prompt_version TEXT REFERENCES prompt_version(id),
+  ADD COLUMN IF NOT EXISTS innovation_prompt_version TEXT REFERENCES prompt_version(id);
+
+ALTER TABLE response_answer
+  ADD COLUMN IF NOT EXISTS position INTEGER,
+  ADD COLUMN IF NOT EXISTS presented_order TEXT[];
+
 -- Create an index on the foreign key for better performance
-CREATE INDEX idx_chat_response_id ON chat(response_id);
-CREATE INDEX idx_response_survey_id ON response(survey_id);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_chat_response_id ON chat(response_id);
+CREATE INDEX IF NOT EXISTS idx_chat_message_response_id ON chat_message(response_id);
+CREATE INDEX IF NOT EXISTS idx_response_survey_id ON response(survey_id);
+CREATE INDEX IF NOT EXISTS idx_allocation_log_survey_id ON allocation_log(survey_id);
+
+-- Copy chats recorded with the per bot columns into chat_message. The first
+-- speaker alternated every question, starting with InnovateBot when
+-- innovate_first is set.
+INSERT INTO chat_message (chat_id, response_id, persona, position, content, prompt_version, settings, meta, created_time)
+SELECT legacy.id, legacy.response_id, bot.persona, bot.position, bot.content, bot.prompt_version, bot.settings, bot.meta, legacy.created_time
+FROM (
+  SELECT chat.*,
+         (ROW_NUMBER() OVER (PARTITION BY chat.response_id ORDER BY chat.created_time) - 1
+          + CASE WHEN response.innovate_first THEN 0 ELSE 1 END) % 2 AS innovation_position
+  FROM chat JOIN response ON response.id = chat.response_id
+) legacy
+CROSS JOIN LATERAL (VALUES
+  ('InnovateBot', legacy.innovation_position, legacy.innovation_msg, legacy.innovation_prompt_version, legacy.innovation_settings, legacy.innovation_meta),
+  ('SafetyBot', 1 - legacy.innovation_position, legacy.safety_msg, legacy.safety_prompt_version, legacy.safety_settings, legacy.safety_meta)
+) AS bot(persona, position, content, prompt_version, settings, meta)
+WHERE NOT EXISTS (SELECT 1 FROM chat_message WHERE chat_message.chat_id = legacy.id);
+
+-- Copy answers recorded in the response columns into response_answer.
+INSERT INTO response_answer (response_id, wave, question_id, value)
+SELECT response.id, answer.wave, answer.question_id, answer.value
+FROM response
+CROSS JOIN LATERAL (VALUES
+  ('pre', 'ai_speed', response.pre_ai_speed),
+  ('pre', 'ai_regulation_approach', response.pre_ai_regulation_approach),
+  ('post', 'which_llm', response.which_llm),
+  ('post', 'ai_speed', response.ai_speed),
+  ('post', 'power_x_bad_actor', response.power_x_bad_actor),
+  ('post', 'ai_regulation_approach', response.ai_regulation_approach),
+  ('post', 'ban_x_no_regulation', response.ban_x_no_regulation),
+  ('post', 'ban_x_mandates', response.ban_x_mandates),
+  ('post', 'mandates_x_no_regulation', response.mandates_x_no_regulation),
+  ('post', 'musk_opinion', response.musk_opinion),
+  ('post', 'patterson_opinion', response.patterson_opinion),
+  ('post', 'kensington_opinion', response.kensington_opinion),
+  ('post', 'potholes', response.potholes)
+) AS answer(wave, question_id, value)
+-- 'missing' was stored for questions left unanswered.
+WHERE answer.value NOT IN ('', 'missing')
+ON CONFLICT DO NOTHING;
+
+-- Responses completed before exits were recorded.
+UPDATE response SET exit_status = 'complete', exit_time = complete_time
+WHERE complete_time IS NOT NULL AND exit_status IS NULL;
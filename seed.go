@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// Purposes a response's randomness is drawn for. Each gets an independent
+// stream so adding a draw for one purpose does not shift the others.
+const (
+	PURPOSE_CELL        = "cell"
+	PURPOSE_ORDER       = "innovate_first"
+	PURPOSE_SUGGESTIONS = "suggestions"
+	PURPOSE_BLOCK       = "block"
+	// PURPOSE_QUESTION_ORDER and PURPOSE_OPTION_ORDER order randomized
+	// questionnaire pages and questions.
+	PURPOSE_QUESTION_ORDER = "question_order"
+	PURPOSE_OPTION_ORDER   = "option_order"
+)
+
+var (
+	responseSeedStmt    *sql.Stmt
+	assignmentAuditStmt *sql.Stmt
+)
+
+// seededRand returns a generator seeded from sha256 of seed and parts, so
+// every draw can be recomputed from values stored in the database.
+func seededRand(seed int64, parts ...string) *rand.Rand {
+	h := sha256.New()
+	h.Write([]byte(strconv.FormatInt(seed, 10)))
+	for _, part := range parts {
+		h.Write([]byte{0})
+		h.Write([]byte(part))
+	}
+	sum := h.Sum(nil)
+	return rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sum[:8]))))
+}
+
+// responseRand returns the generator for one purpose of a response.
+func responseRand(seed int64, responseID uuid.UUID, purpose string) *rand.Rand {
+	return seededRand(seed, responseID.String(), purpose)
+}
+
+// newSeed picks a seed for a survey, or for a response without one.
+func newSeed() int64 {
+	return rand.Int63()
+}
+
+// parseSeed reads the seed sent to /deploy, picking one when it is empty.
+func parseSeed(param string) (int64, error) {
+	if param == "" {
+		return newSeed(), nil
+	}
+	seed, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid seed %s: %v", param, err)
+	}
+	return seed, nil
+}
+
+// shuffled returns a copy of items in the order drawn for purpose.
+func shuffled[T any](items []T, seed int64, responseID uuid.UUID, purpose string) []T {
+	order := slices.Clone(items)
+	r := responseRand(seed, responseID, purpose)
+	r.Shuffle(len(order), func(i, j int) {
+		order[i], order[j] = order[j], order[i]
+	})
+	return order
+}
+
+// loadSuggestions returns the suggested questions responseID has left,
+// starting from the seeded order of the default prompts.
+func loadSuggestions(responseID uuid.UUID) ([]string, error) {
+	if available, ok := suggestionMap.Load(responseID); ok {
+		return available, nil
+	}
+	var seed int64
+	err := responseSeedStmt.QueryRow(responseID).Scan(&seed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute responseSeedStmt: %v", err)
+	}
+	available := shuffled(prompts, seed, responseID, PURPOSE_SUGGESTIONS)
+	suggestionMap.Store(responseID, available)
+	return available, nil
+}
+
+// topicSuggestions returns the suggestions of the topic at section in the
+// order they are offered to responseID.
+func topicSuggestions(topic Topic, section int, seed int64, responseID uuid.UUID) []string {
+	return shuffled(topic.Suggestions, seed, responseID, fmt.Sprintf("%s-%d", PURPOSE_SUGGESTIONS, section))
+}
+
+// AssignmentMismatch is a recorded value that differs from the one
+// recomputed from the seed.
+type AssignmentMismatch struct {
+	ResponseID uuid.UUID `json:"response_id"`
+	Field      string    `json:"field"`
+	Recorded   string    `json:"recorded"`
+	Recomputed string    `json:"recomputed"`
+}
+
+type AssignmentAudit struct {
+	SurveyID   uuid.UUID            `json:"survey_id"`
+	Seed       int64                `json:"seed"`
+	Method     string               `json:"method"`
+	Checked    int                  `json:"checked"`
+	Mismatches []AssignmentMismatch `json:"mismatches"`
+}
+
+func (audit *AssignmentAudit) compare(responseID uuid.UUID, field string, recorded string, recomputed string) {
+	if recorded != recomputed {
+		audit.Mismatches = append(audit.Mismatches, AssignmentMismatch{
+			ResponseID: responseID,
+			Field:      field,
+			Recorded:   recorded,
+			Recomputed: recomputed,
+		})
+	}
+}
+
+// compareAllocation recomputes the bandit probabilities from the arm counts
+// logged with a response.
+func (audit *AssignmentAudit) compareAllocation(responseID uuid.UUID, config SurveyConfig, logged *Allocation) {
+	if config.Design.Bandit == nil {
+		audit.compare(responseID, "allocation", "logged", "no bandit")
+		return
+	}
+	recomputed := &Allocation{BurnIn: logged.BurnIn, Arms: slices.Clone(logged.Arms)}
+	recomputed.setProbabilities(config.Design.Bandit, seededRand(config.Seed, PURPOSE_BANDIT, responseID.String()))
+	for i, arm := range logged.Arms {
+		audit.compare(responseID, "probability:"+arm.Cell,
+			strconv.FormatFloat(arm.Probability, 'g', -1, 64),
+			strconv.FormatFloat(recomputed.Arms[i].Probability, 'g', -1, 64))
+	}
+}
+
+// auditAssignments recomputes the assignment of every response of a survey
+// from the survey seed, the response ID, the stored demographics and the
+// response's block slot or bandit allocation, and reports anything that differs from what was
+// recorded. Block slots are also checked for reuse. Participants turned away
+// over quota were never assigned and are left out.
+func auditAssignments(surveyID uuid.UUID) (*AssignmentAudit, error) {
+	var config SurveyConfig
+	err := config.Scan(surveyConfigQueryStmt.QueryRow(surveyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get survey config: %v", err)
+	}
+	audit := &AssignmentAudit{
+		SurveyID:   surveyID,
+		Seed:       config.Seed,
+		Method:     config.Design.Method,
+		Mismatches: []AssignmentMismatch{},
+	}
+
+	rows, err := assignmentAuditStmt.Query(surveyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute assignmentAuditStmt: %v", err)
+	}
+	defer rows.Close()
+
+	slots := map[string]uuid.UUID{}
+	for rows.Next() {
+		var responseID uuid.UUID
+		var participant Participant
+		var seed sql.NullInt64
+		var cell, stratum, condition sql.NullString
+		var innovateFirst bool
+		var blockNumber, blockIndex sql.NullInt64
+		var allocationArms []byte
+		var burnIn sql.NullBool
+		err := rows.Scan(
+			&responseID,
+			&seed,
+			&participant.Age,
+			&participant.Gender,
+			&participant.Hispanic,
+			&participant.Ethnicity,
+			&participant.StandardVote,
+			&participant.Zip,
+			&cell,
+			&stratum,
+			&condition,
+			&innovateFirst,
+			&blockNumber,
+			&blockIndex,
+			&allocationArms,
+			&burnIn,
+		)
+		if err != nil {
+			return nil, err
+		}
+		audit.Checked++
+
+		var slot *BlockSlot
+		if blockNumber.Valid && blockIndex.Valid {
+			slot = &BlockSlot{Number: int(blockNumber.Int64), Index: int(blockIndex.Int64)}
+		}
+		var allocation *Allocation
+		if len(allocationArms) > 0 {
+			allocation = &Allocation{BurnIn: burnIn.Bool}
+			if err := json.Unmarshal(allocationArms, &allocation.Arms); err != nil {
+				return nil, fmt.Errorf("unable to decode allocation of %s: %v", responseID, err)
+			}
+			audit.compareAllocation(responseID, config, allocation)
+		}
+		ra := config.Design.assignment(config.Seed, responseID, config.Design.Stratum(participant), slot, allocation)
+
+		audit.compare(responseID, "seed", fmt.Sprint(seed.Int64), fmt.Sprint(config.Seed))
+		audit.compare(responseID, "stratum", stratum.String, ra.Stratum)
+		audit.compare(responseID, "cell", cell.String, ra.Cell)
+		audit.compare(responseID, "condition", condition.String, ra.Condition)
+		audit.compare(responseID, "innovate_first", strconv.FormatBool(innovateFirst), strconv.FormatBool(ra.InnovateFirst))
+		if slot != nil {
+			key := fmt.Sprintf("%s/%d/%d", ra.Stratum, slot.Number, slot.Index)
+			if other, ok := slots[key]; ok {
+				audit.compare(responseID, "block_slot", key, "also used by "+other.String())
+			}
+			slots[key] = responseID
+		}
+	}
+	return audit, rows.Err()
+}
+
+func handleAssignmentAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != os.Getenv("LUCIDHQ_API_KEY") {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	surveyID, err := uuid.Parse(r.URL.Query().Get("survey-id"))
+	if err != nil {
+		log.Printf("unable to parse survey-id %s: %v\n", r.URL.Query().Get("survey-id"), err)
+		http.Error(w, "invalid survey-id parameter", http.StatusBadRequest)
+		return
+	}
+	audit, err := auditAssignments(surveyID)
+	if err != nil {
+		log.Printf("failed to audit assignments: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(audit)
+	if err != nil {
+		log.Printf("unable to encode assignment audit: %v\n", err)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/loganamcnichols/ai-debate/lucid"
+)
+
+var (
+	quotaInsertStmt *sql.Stmt
+	quotaFillStmt   *sql.Stmt
+)
+
+// LucidQuestion is a Lucid standard question respondents are qualified on.
+// Its answer is passed in the survey link and stored on the response.
+type LucidQuestion struct {
+	Name       string
+	QuestionID int
+	// PreCodes are every answer to the question, which are qualified unless
+	// the deploy targets others. Open-ended questions have none and are
+	// only qualified when the deploy targets them.
+	PreCodes []string
+}
+
+// LUCID_QUESTIONS match the parameters of TEMPLATE_PARAMS and the
+// demographic columns of response. ZIP is only passed to the survey link of
+// surveys that target it.
+var LUCID_QUESTIONS = []LucidQuestion{
+	{Name: "AGE", QuestionID: 42, PreCodes: precodeRange(18, 99)},
+	{Name: "GENDER", QuestionID: 43, PreCodes: precodeRange(1, 2)},
+	{Name: "HISPANIC", QuestionID: 47, PreCodes: precodeRange(1, 16)},
+	{Name: "ETHNICITY", QuestionID: 113, PreCodes: precodeRange(1, 16)},
+	{Name: "STANDARD_VOTE", QuestionID: 634, PreCodes: precodeRange(1, 3)},
+	{Name: "ZIP", QuestionID: 45},
+}
+
+func lucidQuestion(name string) (LucidQuestion, bool) {
+	for _, question := range LUCID_QUESTIONS {
+		if question.Name == name {
+			return question, true
+		}
+	}
+	return LucidQuestion{}, false
+}
+
+func precodeRange(from int, to int) []string {
+	var precodes []string
+	for i := from; i <= to; i++ {
+		precodes = append(precodes, strconv.Itoa(i))
+	}
+	return precodes
+}
+
+// expandPrecodes replaces ranges such as "18-34" with their precodes.
+func expandPrecodes(precodes []string) ([]string, error) {
+	var expanded []string
+	for _, precode := range precodes {
+		from, to, ok := strings.Cut(precode, "-")
+		if !ok {
+			expanded = append(expanded, precode)
+			continue
+		}
+		first, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid precode range %q", precode)
+		}
+		last, err := strconv.Atoi(to)
+		if err != nil || last < first {
+			return nil, fmt.Errorf("invalid precode range %q", precode)
+		}
+		expanded = append(expanded, precodeRange(first, last)...)
+	}
+	return expanded, nil
+}
+
+// Targeting is who a survey is fielded to, sent to /deploy as a JSON object.
+//
+//	{
+//	  "qualifications": {"AGE": ["18-64"]},
+//	  "quotas": [{"question": "STANDARD_VOTE", "cells": [
+//	    {"name": "democrat", "precodes": ["1"], "share": 0.5},
+//	    {"name": "republican", "precodes": ["2"], "share": 0.5}
+//	  ]}]
+//	}
+type Targeting struct {
+	// Qualifications replace the precodes qualified for a question. Other
+	// questions qualify the precodes of their quota cells, or their
+	// default precodes without quotas.
+	Qualifications map[string][]string `json:"qualifications,omitempty"`
+	Quotas         []QuotaGroup        `json:"quotas,omitempty"`
+}
+
+// QuotaGroup splits the survey quantity between answers to one question.
+type QuotaGroup struct {
+	Question string      `json:"question"`
+	Cells    []QuotaCell `json:"cells"`
+}
+
+type QuotaCell struct {
+	Name     string   `json:"name"`
+	PreCodes []string `json:"precodes"`
+	// Share is the fraction of the survey quantity in the cell. The shares
+	// of a group add up to 1.
+	Share float64 `json:"share"`
+}
+
+// parseTargeting decodes the targeting sent to /deploy. An empty parameter
+// qualifies every question on its default precodes without quotas.
+func parseTargeting(param string) (Targeting, error) {
+	var t Targeting
+	if param == "" {
+		return t, nil
+	}
+	if err := json.Unmarshal([]byte(param), &t); err != nil {
+		return t, fmt.Errorf("invalid targeting: %v", err)
+	}
+	for name, precodes := range t.Qualifications {
+		if _, ok := lucidQuestion(name); !ok {
+			return t, fmt.Errorf("unknown qualification %q", name)
+		}
+		expanded, err := expandPrecodes(precodes)
+		if err != nil {
+			return t, fmt.Errorf("qualification %s: %v", name, err)
+		}
+		if len(expanded) == 0 {
+			return t, fmt.Errorf("qualification %s needs precodes", name)
+		}
+		t.Qualifications[name] = expanded
+	}
+	questions := map[string]bool{}
+	for i := range t.Quotas {
+		if err := t.Quotas[i].validate(t.Qualifications); err != nil {
+			return t, fmt.Errorf("quota on %s: %v", t.Quotas[i].Question, err)
+		}
+		if questions[t.Quotas[i].Question] {
+			return t, fmt.Errorf("more than one quota on %s", t.Quotas[i].Question)
+		}
+		questions[t.Quotas[i].Question] = true
+	}
+	return t, nil
+}
+
+// validate checks the group and expands the precode ranges of its cells.
+func (g *QuotaGroup) validate(qualifications map[string][]string) error {
+	if _, ok := lucidQuestion(g.Question); !ok {
+		return errors.New("unknown question")
+	}
+	if len(g.Cells) < 2 {
+		return errors.New("a quota needs at least two cells")
+	}
+	names := map[string]bool{}
+	precodes := map[string]bool{}
+	total := 0.0
+	for i, cell := range g.Cells {
+		if cell.Name == "" || names[cell.Name] {
+			return fmt.Errorf("invalid or duplicate cell name %q", cell.Name)
+		}
+		names[cell.Name] = true
+		if cell.Share <= 0 {
+			return fmt.Errorf("cell %s needs a positive share", cell.Name)
+		}
+		total += cell.Share
+		expanded, err := expandPrecodes(cell.PreCodes)
+		if err != nil {
+			return fmt.Errorf("cell %s: %v", cell.Name, err)
+		}
+		if len(expanded) == 0 {
+			return fmt.Errorf("cell %s needs precodes", cell.Name)
+		}
+		for _, precode := range expanded {
+			if precodes[precode] {
+				return fmt.Errorf("precode %s is in more than one cell", precode)
+			}
+			precodes[precode] = true
+			if qualified, ok := qualifications[g.Question]; ok && !slices.Contains(qualified, precode) {
+				return fmt.Errorf("precode %s of cell %s is not qualified", precode, cell.Name)
+			}
+		}
+		g.Cells[i].PreCodes = expanded
+	}
+	if math.Abs(total-1) > 1e-6 {
+		return fmt.Errorf("cell shares add up to %g instead of 1", total)
+	}
+	return nil
+}
+
+// qualifications returns the qualifications sent to Lucid, one for each of
+// LUCID_QUESTIONS that has precodes. Every qualification has precodes, as
+// Lucid does not accept a qualification without any.
+func (t Targeting) qualifications() []lucid.Qualification {
+	var qualifications []lucid.Qualification
+	for _, question := range LUCID_QUESTIONS {
+		precodes, ok := t.Qualifications[question.Name]
+		if !ok {
+			precodes = question.PreCodes
+			for _, group := range t.Quotas {
+				if group.Question != question.Name {
+					continue
+				}
+				precodes = nil
+				for _, cell := range group.Cells {
+					precodes = append(precodes, cell.PreCodes...)
+				}
+			}
+		}
+		if len(precodes) == 0 {
+			continue
+		}
+		qualifications = append(qualifications, lucid.Qualification{
+			Name:            question.Name,
+			QuestionID:      question.QuestionID,
+			LogicalOperator: lucid.LOGICAL_OR,
+			IsActive:        true,
+			Order:           len(qualifications) + 1,
+			PreCodes:        append([]string{}, precodes...),
+		})
+	}
+	return qualifications
+}
+
+// SurveyQuota is a quota cell of a deployed survey.
+type SurveyQuota struct {
+	Question string   `json:"question"`
+	Cell     string   `json:"cell"`
+	PreCodes []string `json:"precodes"`
+	Quota    int      `json:"quota"`
+	// LucidQuotaID is set once the quota is created in Lucid.
+	LucidQuotaID *int `json:"lucid_quota_id"`
+}
+
+// surveyQuotas splits quantity between the cells of every quota group.
+// Cells get the floor of their share and the remainder goes to the cells
+// with the largest fractions, so every group adds up to quantity.
+func (t Targeting) surveyQuotas(quantity int) []SurveyQuota {
+	var quotas []SurveyQuota
+	for _, group := range t.Quotas {
+		counts := make([]int, len(group.Cells))
+		fractions := make([]float64, len(group.Cells))
+		remainder := quantity
+		for i, cell := range group.Cells {
+			exact := cell.Share * float64(quantity)
+			counts[i] = int(math.Floor(exact))
+			fractions[i] = exact - float64(counts[i])
+			remainder -= counts[i]
+		}
+		order := make([]int, len(group.Cells))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool { return fractions[order[a]] > fractions[order[b]] })
+		for i := 0; i < remainder; i++ {
+			counts[order[i%len(order)]]++
+		}
+		for i, cell := range group.Cells {
+			quotas = append(quotas, SurveyQuota{
+				Question: group.Question,
+				Cell:     cell.Name,
+				PreCodes: cell.PreCodes,
+				Quota:    counts[i],
+			})
+		}
+	}
+	return quotas
+}
+
+// lucidQuota is the Lucid quota of q.
+func (q SurveyQuota) lucidQuota() lucid.Quota {
+	question, _ := lucidQuestion(q.Question)
+	return lucid.Quota{
+		Name:     q.Question + " " + q.Cell,
+		Quota:    q.Quota,
+		IsActive: true,
+		Conditions: []lucid.QuotaCondition{
+			{QuestionID: question.QuestionID, PreCodes: q.PreCodes},
+		},
+	}
+}
+
+// insertQuotas stores the quotas of the survey inserted within tx.
+func insertQuotas(tx *sql.Tx, surveyID uuid.UUID, quotas []SurveyQuota) error {
+	for i, quota := range quotas {
+		_, err := tx.Stmt(quotaInsertStmt).Exec(surveyID, quota.Question, quota.Cell, pq.Array(quota.PreCodes), quota.Quota, quota.LucidQuotaID, i)
+		if err != nil {
+			return fmt.Errorf("failed to execute quotaInsertStmt: %v", err)
+		}
+	}
+	return nil
+}
+
+// QuotaFill is the progress of a quota cell counted from the responses.
+// Lucid counts the survey quantity in prescreens, so Remaining is based on
+// the responses started. Responses that exited without completing do not
+// count.
+type QuotaFill struct {
+	SurveyQuota
+	Started   int `json:"started"`
+	Completed int `json:"completed"`
+	Remaining int `json:"remaining"`
+}
+
+func quotaFill(surveyID uuid.UUID) ([]QuotaFill, error) {
+	rows, err := quotaFillStmt.Query(surveyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute quotaFillStmt: %v", err)
+	}
+	defer rows.Close()
+
+	fills := []QuotaFill{}
+	for rows.Next() {
+		var fill QuotaFill
+		err := rows.Scan(&fill.Question, &fill.Cell, pq.Array(&fill.PreCodes), &fill.Quota, &fill.LucidQuotaID,
+			&fill.Started, &fill.Completed)
+		if err != nil {
+			return nil, err
+		}
+		fill.Remaining = max(fill.Quota-fill.Started, 0)
+		fills = append(fills, fill)
+	}
+	return fills, rows.Err()
+}
+
+func handleQuotas(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != os.Getenv("LUCIDHQ_API_KEY") {
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	surveyID, err := uuid.Parse(r.URL.Query().Get("survey-id"))
+	if err != nil {
+		log.Printf("unable to parse survey-id %s: %v\n", r.URL.Query().Get("survey-id"), err)
+		http.Error(w, "invalid survey-id parameter", http.StatusBadRequest)
+		return
+	}
+	fills, err := quotaFill(surveyID)
+	if err != nil {
+		log.Printf("failed to count quota fill: %v\n", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(fills)
+	if err != nil {
+		log.Printf("unable to encode quota fill: %v\n", err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Topic is one timed section of the debate.
+type Topic struct {
+	Title string `json:"title"`
+	// Opening is sent to the bots as the first question of the section. It
+	// defaults to the title.
+	Opening string `json:"opening,omitempty"`
+	// DurationMinutes fixes the length of the section. Sections without a
+	// duration share the rest of the chat time in proportion to Weight.
+	DurationMinutes float64 `json:"duration_minutes,omitempty"`
+	Weight          float64 `json:"weight,omitempty"`
+	// Suggestions replace the suggested questions when the section starts.
+	// When empty the participant keeps the suggestions they have left.
+	Suggestions []string `json:"suggestions,omitempty"`
+	// Reading is shown instead of a bot conversation in the static condition.
+	// Paragraphs are separated by newlines.
+	Reading string `json:"reading,omitempty"`
+	// Answers are the opening answers to the topic by prompt name, which
+	// prompts render as .Topic.Answer.
+	Answers map[string]string `json:"answers,omitempty"`
+}
+
+// TopicListItem is the data for the "topic-list" template.
+type TopicListItem struct {
+	Index int
+	Title string
+}
+
+var DEFAULT_TOPICS = []Topic{
+	{
+		Title: "Regulation vs. Deregulation in AI Development",
+		Reading: `Supporters of lighter regulation argue that AI is improving quickly and that rules written today may slow useful products, favor large incumbents and push development to other countries.
+Supporters of stronger regulation argue that powerful systems carry risks such as security breaches and misuse, and that requirements like safety testing and transparency reports can catch problems before they cause harm.
+Proposals under discussion include mandatory testing of the most capable models, disclosure requirements, liability for developers, and export controls.`,
+		Answers: map[string]string{
+			INNOVATION_PROMPT: "Excessive regulation stifles breakthrough progress and economic growth. Fewer restrictions enable faster development of transformative AI technologies.",
+			SAFETY_PROMPT: "Rapid advances carry unpredictable risks—from cybersecurity breaches to potential loss of human control.\n" +
+				"Mandatory safety testing and stringent security measures can avert catastrophic failures.",
+		},
+	},
+	{
+		Title: "Economic Transformation: Job Creation vs. Displacement",
+		Reading: `AI tools can make workers more productive and may create new kinds of jobs and businesses, as earlier technologies did.
+They may also automate tasks faster than workers can retrain, which could cause job losses and widen inequality in the short term.
+Policy ideas include retraining programs, changes to the safety net, and slowing or speeding deployment in particular sectors.`,
+		Answers: map[string]string{
+			INNOVATION_PROMPT: "AI can create entirely new industries and opportunities, spurring job growth and economic dynamism. Embracing innovation leads to cost reductions and enhances global competitiveness.",
+			SAFETY_PROMPT: "Rapid AI deployment may upend labor markets, causing widespread job losses and inequality.\n" +
+				"Prioritizing safety ensures that economic transitions include safeguards for vulnerable workers.",
+		},
+	},
+	{
+		Title: "Developing Super-Human General-Purpose AI",
+		Reading: `Some researchers expect AI systems that outperform people at most tasks to be built within decades, and argue they could speed up science and medicine.
+Others worry such systems could be hard to control or could concentrate power, and call for strict oversight before they are developed.
+Opinions differ on how close such systems are, how risky they would be, and whether governments or companies should decide how they are built.`,
+		Answers: map[string]string{
+			INNOVATION_PROMPT: "Super-human AI holds the promise of solving complex global issues, but overregulation could delay these benefits and cede leadership to less cautious competitors. Adaptive governance models that balance flexibility with accountability can foster rapid innovation while addressing key safety concerns.",
+			SAFETY_PROMPT: "The unprecedented capabilities of super-human AI necessitate strict governance to mitigate existential risks.\n" +
+				"Comprehensive safety protocols, including mandatory testing and global oversight, are essential to ensure human control and prevent unintended catastrophic outcomes.",
+		},
+	},
+}
+
+func (t Topic) OpeningMessage() string {
+	if t.Opening == "" {
+		return t.Title
+	}
+	return t.Opening
+}
+
+func validateTopics(topics []Topic, chatTime int) error {
+	if len(topics) == 0 {
+		return errors.New("at least one topic is required")
+	}
+	var fixed float64
+	for i, topic := range topics {
+		if topic.Title == "" {
+			return fmt.Errorf("topic %d has no title", i+1)
+		}
+		if topic.DurationMinutes < 0 || topic.Weight < 0 {
+			return fmt.Errorf("topic %d has a negative duration or weight", i+1)
+		}
+		for prompt := range topic.Answers {
+			if _, ok := PROMPT_FILES[prompt]; !ok {
+				return fmt.Errorf("topic %d has an answer for unknown prompt %q", i+1, prompt)
+			}
+		}
+		fixed += topic.DurationMinutes
+	}
+	if fixed > float64(chatTime) {
+		return fmt.Errorf("topic durations add up to %v minutes, more than the chat time of %d", fixed, chatTime)
+	}
+	return nil
+}
+
+// parseTopics decodes the topics JSON array sent to /deploy. An empty
+// parameter keeps the default topics.
+func parseTopics(param string, chatTime int) ([]Topic, error) {
+	if param == "" {
+		return DEFAULT_TOPICS, nil
+	}
+	var topics []Topic
+	if err := json.Unmarshal([]byte(param), &topics); err != nil {
+		return nil, fmt.Errorf("invalid topics: %v", err)
+	}
+	return topics, validateTopics(topics, chatTime)
+}
+
+// topicSchedule returns the offset from the start of the chat at which each
+// topic begins. Topics with a fixed duration keep it; the remaining time is
+// split between the others by weight, with a missing weight counting as 1.
+func topicSchedule(topics []Topic, chatTime int) []time.Duration {
+	total := time.Duration(chatTime) * time.Minute
+	var fixed time.Duration
+	var weights float64
+	for _, topic := range topics {
+		if topic.DurationMinutes > 0 {
+			fixed += time.Duration(topic.DurationMinutes * float64(time.Minute))
+		} else {
+			weights += topicWeight(topic)
+		}
+	}
+	flexible := max(total-fixed, 0)
+
+	starts := make([]time.Duration, len(topics))
+	var offset time.Duration
+	for i, topic := range topics {
+		starts[i] = offset
+		if topic.DurationMinutes > 0 {
+			offset += time.Duration(topic.DurationMinutes * float64(time.Minute))
+		} else {
+			offset += time.Duration(float64(flexible) * topicWeight(topic) / weights)
+		}
+	}
+	return starts
+}
+
+// scheduledSection returns the 1-based index of the topic under way elapsed
+// into a chat with schedule.
+func scheduledSection(schedule []time.Duration, elapsed time.Duration) int {
+	section := 1
+	for i, start := range schedule {
+		if i > 0 && start <= elapsed {
+			section = i + 1
+		}
+	}
+	return section
+}
+
+func topicWeight(topic Topic) float64 {
+	if topic.Weight == 0 {
+		return 1
+	}
+	return topic.Weight
+}
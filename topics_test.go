@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduledSection(t *testing.T) {
+	schedule := topicSchedule(DEFAULT_TOPICS, 15)
+	tests := []struct {
+		elapsed time.Duration
+		want    int
+	}{
+		{0, 1},
+		{schedule[1] - time.Second, 1},
+		{schedule[1], 2},
+		{schedule[2] + time.Minute, 3},
+		// The last topic lasts until the participant leaves the chat.
+		{time.Hour, 3},
+	}
+	for _, test := range tests {
+		if got := scheduledSection(schedule, test.elapsed); got != test.want {
+			t.Errorf("section %s into the chat = %d, want %d", test.elapsed, got, test.want)
+		}
+	}
+}
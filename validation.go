@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// AnswerError is a submitted answer that was not accepted.
+type AnswerError struct {
+	Value   string
+	Message string
+}
+
+// pageAnswers reads the answers to the questions of page from form and
+// checks them against the question metadata. Questions missing from the
+// form, such as radio groups left unselected, are checked against their
+// previous answer. Only valid answers are returned; the others are returned
+// as errors keyed by question ID.
+func pageAnswers(page Page, form url.Values, previous map[string]string) (map[string]string, map[string]AnswerError) {
+	answers := map[string]string{}
+	invalid := map[string]AnswerError{}
+	for _, question := range page.Questions {
+		value, submitted := question.formValue(form)
+		if !submitted {
+			value = previous[question.ID]
+		}
+		if message := question.checkAnswer(value); message != "" {
+			invalid[question.ID] = AnswerError{Value: value, Message: message}
+			continue
+		}
+		if submitted {
+			answers[question.ID] = value
+		}
+	}
+	return answers, invalid
+}
+
+// formValue encodes the answer to q in form the way it is stored. Likert
+// rows and ranking options are submitted as separate fields named after the
+// question and the item or option, e.g. "trust.openai".
+func (q Question) formValue(form url.Values) (string, bool) {
+	field := func(name string) (string, bool) {
+		values, ok := form[name]
+		if !ok {
+			return "", false
+		}
+		return strings.TrimSpace(values[len(values)-1]), true
+	}
+	switch q.Type {
+	case QUESTION_LIKERT:
+		grid := map[string]string{}
+		for _, item := range q.Items {
+			if value, ok := field(q.ID + "." + item.Value); ok && value != "" {
+				grid[item.Value] = value
+			}
+		}
+		if len(grid) == 0 {
+			return "", false
+		}
+		return encodeJSON(grid), true
+	case QUESTION_SLIDER:
+		// A range input always submits a value, so the slider counts as
+		// answered only once the participant has moved it.
+		value, ok := field(q.ID)
+		if !ok {
+			return "", false
+		}
+		if touched, _ := field(q.ID + ".touched"); touched != "true" {
+			return "", true
+		}
+		return value, true
+	case QUESTION_RANKING:
+		// An option left unranked or two options given the same rank leave
+		// a gap the ranking check reports. A ranking with no option ranked
+		// is not answered.
+		ranking := make([]string, len(q.Options))
+		var submitted, ranked bool
+		for _, option := range q.Options {
+			value, ok := field(q.ID + "." + option.Value)
+			if !ok {
+				continue
+			}
+			submitted = true
+			if value == "" {
+				continue
+			}
+			ranked = true
+			rank, err := strconv.Atoi(value)
+			if err == nil && rank >= 1 && rank <= len(ranking) && ranking[rank-1] == "" {
+				ranking[rank-1] = option.Value
+			}
+		}
+		if !submitted {
+			return "", false
+		}
+		if !ranked {
+			return "", true
+		}
+		return encodeJSON(ranking), true
+	}
+	return field(q.ID)
+}
+
+func encodeJSON(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// checkAnswer returns why value is not an acceptable answer to q, or an
+// empty string if it is. The message is shown to the participant.
+func (q Question) checkAnswer(value string) string {
+	if value == "" {
+		if q.Required {
+			return "This question is required."
+		}
+		return ""
+	}
+	switch q.Type {
+	case QUESTION_SINGLE_CHOICE:
+		if !q.hasOption(value) {
+			return "You must select one of the options."
+		}
+	case QUESTION_LIKERT:
+		grid := map[string]string{}
+		if err := json.Unmarshal([]byte(value), &grid); err != nil {
+			return "Please answer every row."
+		}
+		for item, option := range grid {
+			if !slices.ContainsFunc(q.Items, func(o Option) bool { return o.Value == item }) || !q.hasOption(option) {
+				return "Please choose one of the options in every row."
+			}
+		}
+		if q.Required && len(grid) < len(q.Items) {
+			return "Please answer every row."
+		}
+	case QUESTION_SLIDER:
+		n, err := strconv.ParseFloat(value, 64)
+		min, max := q.sliderBounds()
+		if err != nil || n < min || n > max {
+			return fmt.Sprintf("Please choose a number from %g to %g.", min, max)
+		}
+		if steps := (n - min) / q.sliderStep(); math.Abs(steps-math.Round(steps)) > 1e-9 {
+			return fmt.Sprintf("Please choose a number in steps of %g.", q.sliderStep())
+		}
+	case QUESTION_RANKING:
+		var ranking []string
+		if err := json.Unmarshal([]byte(value), &ranking); err != nil || len(ranking) != len(q.Options) {
+			return "Please rank every option."
+		}
+		for _, option := range ranking {
+			if !q.hasOption(option) {
+				return "Please give every option a different rank."
+			}
+		}
+	case QUESTION_TEXT:
+		length := utf8.RuneCountInString(value)
+		if q.MinLength > 0 && length < q.MinLength {
+			return fmt.Sprintf("Please write at least %d characters.", q.MinLength)
+		}
+		if q.MaxLength > 0 && length > q.MaxLength {
+			return fmt.Sprintf("Please write at most %d characters.", q.MaxLength)
+		}
+	}
+	return ""
+}
+
+func (q Question) hasOption(value string) bool {
+	for _, option := range q.Options {
+		if option.Value == value {
+			return true
+		}
+	}
+	return false
+}